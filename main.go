@@ -19,18 +19,30 @@ import (
 	"github.com/spf13/afero"
 	"github.com/xenitab/pkg/kubernetes"
 	"go.uber.org/zap"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/xenitab/git-auth-proxy/pkg/auth"
 	"github.com/xenitab/git-auth-proxy/pkg/config"
+	"github.com/xenitab/git-auth-proxy/pkg/crd"
 	"github.com/xenitab/git-auth-proxy/pkg/server"
 	"github.com/xenitab/git-auth-proxy/pkg/token"
 )
 
+// credentialsWatchInterval is the interval at which referenced credentials are read when reloading is disabled.
+const credentialsWatchInterval = time.Minute
+
 type Arguments struct {
-	Addr           string `arg:"--addr" default:":8080"`
-	MetricsAddr    string `arg:"--metrics-addr" default:":9090"`
-	CfgPath        string `arg:"--config,required"`
-	KubeconfigPath string `arg:"--kubeconfig"`
+	Addr                string        `arg:"--addr" default:":8080"`
+	MetricsAddr         string        `arg:"--metrics-addr" default:":9090"`
+	CfgPath             string        `arg:"--config,required"`
+	KubeconfigPath      string        `arg:"--kubeconfig"`
+	RefreshInterval     time.Duration `arg:"--refresh-interval" default:"5m"`
+	PersistTokens       bool          `arg:"--persist-tokens"`
+	RotationInterval    time.Duration `arg:"--token-rotation-interval" default:"0"`
+	RotationGracePeriod time.Duration `arg:"--token-rotation-grace-period" default:"1h"`
+	ReloadInterval      time.Duration `arg:"--config-reload-interval" default:"1m"`
+	EnableCRDs          bool          `arg:"--enable-crds"`
 }
 
 func main() {
@@ -44,28 +56,47 @@ func main() {
 	log := zapr.NewLogger(zapLog)
 	ctx := logr.NewContext(context.Background(), log)
 
-	if err := run(ctx, args.Addr, args.MetricsAddr, args.CfgPath, args.KubeconfigPath); err != nil {
+	if err := run(ctx, args); err != nil {
 		log.Error(err, "")
 		os.Exit(1)
 	}
 	log.Info("gracefully shutdown")
 }
 
-func run(ctx context.Context, addr, metricsAddr, cfgPath, kubeconfigPath string) error {
-	authz, err := getAutorization(cfgPath)
+func run(ctx context.Context, args *Arguments) error {
+	client, err := kubernetes.GetKubernetesClientset(args.KubeconfigPath)
 	if err != nil {
 		return err
 	}
-	client, err := kubernetes.GetKubernetesClientset(kubeconfigPath)
+	cfg, err := config.LoadConfiguration(afero.NewOsFs(), args.CfgPath)
 	if err != nil {
+		return fmt.Errorf("could not load configuration: %w", err)
+	}
+	hasCredentialReferences := cfg.HasCredentialReferences()
+	if err := config.ResolveCredentials(ctx, afero.NewOsFs(), client, cfg); err != nil {
 		return err
 	}
+	authz, err := auth.NewAuthorizer(cfg)
+	if err != nil {
+		return fmt.Errorf("could not generate authorization: %w", err)
+	}
+	// Service accounts can be added at runtime when the configuration is reloaded or read from custom resources
+	var authn *auth.ServiceAccountAuthenticator
+	if authz.UsesServiceAccounts() || args.ReloadInterval > 0 || args.EnableCRDs {
+		authn = auth.NewServiceAccountAuthenticator(client, cfg.ServiceAccountAuth.Audiences)
+	}
+	tokenWriter := token.NewTokenWriter(client, authz)
+	if args.PersistTokens {
+		if err := tokenWriter.LoadTokens(ctx); err != nil {
+			return fmt.Errorf("could not load tokens: %w", err)
+		}
+	}
 
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGTERM)
 	defer cancel()
 	g, ctx := errgroup.WithContext(ctx)
 
-	metricsSrv := &http.Server{ReadTimeout: 5 * time.Second, Addr: metricsAddr, Handler: promhttp.Handler()}
+	metricsSrv := &http.Server{ReadTimeout: 5 * time.Second, Addr: args.MetricsAddr, Handler: promhttp.Handler()}
 	g.Go(func() error {
 		if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
@@ -79,7 +110,45 @@ func run(ctx context.Context, addr, metricsAddr, cfgPath, kubeconfigPath string)
 		return metricsSrv.Shutdown(shutdownCtx)
 	})
 
-	tokenWriter := token.NewTokenWriter(client, authz)
+	g.Go(func() error {
+		return authz.RunRepositoryRefresh(ctx, args.RefreshInterval)
+	})
+	g.Go(func() error {
+		return authz.RunTokenRotation(ctx, args.RotationInterval, args.RotationGracePeriod)
+	})
+	// The configuration file is combined with the custom resources when they are enabled
+	reload := func(cfg *config.Configuration) error {
+		return authz.Reload(ctx, cfg)
+	}
+	updateCredentials := authz.UpdateCredentials
+	if args.EnableCRDs {
+		restCfg, err := clientcmd.BuildConfigFromFlags("", args.KubeconfigPath)
+		if err != nil {
+			return err
+		}
+		dynamicClient, err := dynamic.NewForConfig(restCfg)
+		if err != nil {
+			return err
+		}
+		controller := crd.NewController(dynamicClient, authz, cfg)
+		g.Go(func() error {
+			return controller.Start(ctx)
+		})
+		reload = func(cfg *config.Configuration) error {
+			return controller.SetConfiguration(ctx, cfg)
+		}
+		updateCredentials = controller.SetCredentials
+	}
+	// Referenced credentials are still watched when reloading is disabled, while changes to the file are ignored
+	watchInterval := args.ReloadInterval
+	if watchInterval <= 0 && hasCredentialReferences {
+		watchInterval = credentialsWatchInterval
+		reload = nil
+	}
+	g.Go(func() error {
+		return config.WatchConfiguration(ctx, afero.NewOsFs(), client, args.CfgPath, watchInterval, reload, updateCredentials)
+	})
+
 	g.Go(func() error {
 		if err := tokenWriter.Start(ctx); err != nil {
 			return err
@@ -87,8 +156,8 @@ func run(ctx context.Context, addr, metricsAddr, cfgPath, kubeconfigPath string)
 		return nil
 	})
 
-	gp := server.NewGitProxy(authz)
-	proxySrv := gp.Server(ctx, addr)
+	gp := server.NewGitProxy(authz, authn)
+	proxySrv := gp.Server(ctx, args.Addr)
 	g.Go(func() error {
 		if err := proxySrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
@@ -108,15 +177,3 @@ func run(ctx context.Context, addr, metricsAddr, cfgPath, kubeconfigPath string)
 	}
 	return nil
 }
-
-func getAutorization(path string) (*auth.Authorizer, error) {
-	cfg, err := config.LoadConfiguration(afero.NewOsFs(), path)
-	if err != nil {
-		return nil, fmt.Errorf("could not load configuration: %w", err)
-	}
-	authz, err := auth.NewAuthorizer(cfg)
-	if err != nil {
-		return nil, fmt.Errorf("could not generate authorization: %w", err)
-	}
-	return authz, nil
-}
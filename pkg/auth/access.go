@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+const (
+	receivePackService = "git-receive-pack"
+	uploadPackService  = "git-upload-pack"
+	// gitServicePaths are the smart HTTP and LFS paths which follow the repository path in git requests.
+	gitServicePaths = `(\.git)?/(info/refs|git-upload-pack|git-receive-pack|info/lfs/.+)`
+	lfsBatchPath    = "/info/lfs/objects/batch"
+	// lfsDownloadOperation is the operation of LFS batch requests which only fetch objects.
+	lfsDownloadOperation = "download"
+	// maxLFSBatchSize limits how much of an LFS batch request is read to find its operation.
+	maxLFSBatchSize = 10 << 20
+)
+
+// isAccessPermitted checks that a request does not modify the repository if the access level only permits reads.
+func isAccessPermitted(access config.AccessLevel, req *http.Request) error {
+	if access != config.ReadAccessLevel {
+		return nil
+	}
+	path := req.URL.Path
+	// Paths are matched case insensitively when routing requests, so the service has to be as well
+	if hasSuffixFold(path, "/"+receivePackService) || strings.EqualFold(req.URL.Query().Get("service"), receivePackService) {
+		return fmt.Errorf("read only token not permitted to push to path %s", path)
+	}
+	if isReadRequest(req) {
+		return nil
+	}
+	if req.Method == http.MethodPost {
+		// Fetching with the smart HTTP protocol is done with a POST request
+		if hasSuffixFold(path, "/"+uploadPackService) {
+			return nil
+		}
+		// LFS objects are fetched by requesting their download locations with the batch API
+		if hasSuffixFold(path, lfsBatchPath) {
+			operation, err := readLFSBatchOperation(req)
+			if err != nil {
+				return err
+			}
+			if operation == lfsDownloadOperation {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("read only token not permitted to %s path %s", req.Method, path)
+}
+
+// isReadRequest returns true if the method of the request does not modify any resources.
+func isReadRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// readLFSBatchOperation returns the operation of an LFS batch request. The body is replaced so that it can still be forwarded.
+func readLFSBatchOperation(req *http.Request) (string, error) {
+	if req.Body == nil {
+		return "", errors.New("LFS batch request does not have a body")
+	}
+	b, err := io.ReadAll(io.LimitReader(req.Body, maxLFSBatchSize+1))
+	req.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("could not read LFS batch request: %w", err)
+	}
+	if len(b) > maxLFSBatchSize {
+		return "", fmt.Errorf("LFS batch request is larger than %d bytes", maxLFSBatchSize)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	batch := struct {
+		Operation string `json:"operation"`
+	}{}
+	if err := json.Unmarshal(b, &batch); err != nil {
+		return "", fmt.Errorf("could not parse LFS batch request: %w", err)
+	}
+	return batch.Operation, nil
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// compileGitRequestRegexes returns regexes which only match the git smart HTTP and LFS requests of the repository paths.
+func compileGitRequestRegexes(repositoryPaths []string) ([]*regexp.Regexp, error) {
+	regexes := []*regexp.Regexp{}
+	for _, path := range repositoryPaths {
+		r, err := regexp.Compile(fmt.Sprintf(`(?i)^%s%s$`, path, gitServicePaths))
+		if err != nil {
+			return nil, err
+		}
+		regexes = append(regexes, r)
+	}
+	return regexes, nil
+}
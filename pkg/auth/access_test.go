@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestAccessLevel(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "read",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+						Access:     config.ReadAccessLevel,
+					},
+					{
+						Project:    "proj",
+						Name:       "write",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+						Access:     config.WriteAccessLevel,
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		allowRead  bool
+		allowWrite bool
+	}{
+		{
+			name:       "upload pack ref advertisement",
+			method:     http.MethodGet,
+			path:       "/org/proj/_git/%s/info/refs?service=git-upload-pack",
+			allowRead:  true,
+			allowWrite: true,
+		},
+		{
+			name:       "upload pack",
+			method:     http.MethodPost,
+			path:       "/org/proj/_git/%s/git-upload-pack",
+			allowRead:  true,
+			allowWrite: true,
+		},
+		{
+			name:       "receive pack ref advertisement",
+			method:     http.MethodGet,
+			path:       "/org/proj/_git/%s/info/refs?service=git-receive-pack",
+			allowRead:  false,
+			allowWrite: true,
+		},
+		{
+			name:       "receive pack",
+			method:     http.MethodPost,
+			path:       "/org/proj/_git/%s/git-receive-pack",
+			allowRead:  false,
+			allowWrite: true,
+		},
+		{
+			name:       "receive pack ref advertisement with different case",
+			method:     http.MethodGet,
+			path:       "/org/proj/_git/%s/info/refs?service=Git-Receive-Pack",
+			allowRead:  false,
+			allowWrite: true,
+		},
+		{
+			name:       "lfs batch download",
+			method:     http.MethodPost,
+			path:       "/org/proj/_git/%s/info/lfs/objects/batch",
+			body:       `{"operation": "download", "objects": [{"oid": "foo", "size": 1}]}`,
+			allowRead:  true,
+			allowWrite: true,
+		},
+		{
+			name:       "lfs batch upload",
+			method:     http.MethodPost,
+			path:       "/org/proj/_git/%s/info/lfs/objects/batch",
+			body:       `{"operation": "upload", "objects": [{"oid": "foo", "size": 1}]}`,
+			allowRead:  false,
+			allowWrite: true,
+		},
+		{
+			name:       "lfs lock",
+			method:     http.MethodPost,
+			path:       "/org/proj/_git/%s/info/lfs/locks",
+			body:       `{"path": "foo"}`,
+			allowRead:  false,
+			allowWrite: true,
+		},
+		{
+			name:       "api get",
+			method:     http.MethodGet,
+			path:       "/org/proj/_apis/git/repositories/%s/pullrequests",
+			allowRead:  true,
+			allowWrite: true,
+		},
+		{
+			name:       "api post",
+			method:     http.MethodPost,
+			path:       "/org/proj/_apis/git/repositories/%s/pullrequests",
+			allowRead:  false,
+			allowWrite: true,
+		},
+		{
+			name:       "api delete",
+			method:     http.MethodDelete,
+			path:       "/org/proj/_apis/git/repositories/%s/pullrequests/1/reviewers/foo",
+			allowRead:  false,
+			allowWrite: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, repo := range []string{"read", "write"} {
+				endpoint, err := authz.GetEndpointById("foo-org-proj-" + repo)
+				require.NoError(t, err)
+				req := httptest.NewRequest(tt.method, fmt.Sprintf(tt.path, repo), strings.NewReader(tt.body))
+				err = authz.IsRequestPermitted(req, endpoint.Grants[0].Token)
+				allow := tt.allowWrite
+				if repo == "read" {
+					allow = tt.allowRead
+				}
+				if allow {
+					require.NoError(t, err)
+				} else {
+					require.Error(t, err)
+				}
+				// The body has to be forwarded even if it was read to check the request
+				body, err := io.ReadAll(req.Body)
+				require.NoError(t, err)
+				require.Equal(t, tt.body, string(body))
+			}
+		})
+	}
+}
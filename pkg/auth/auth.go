@@ -2,100 +2,446 @@ package auth
 
 import (
 	"context"
-	b64 "encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/xenitab/git-auth-proxy/pkg/config"
 )
 
 type Provider interface {
 	getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error)
+	// getGitPaths returns regexes of the repository paths which the git smart HTTP and LFS paths are appended to.
+	getGitPaths(organization, project, repository string) []string
 	getAuthorizationHeader(ctx context.Context, path string) (string, error)
 	getHost(e *Endpoint, path string) string
 	getPath(e *Endpoint, path string) string
 }
 
+// repositoryProvider is implemented by providers which use separate credentials for each repository.
+type repositoryProvider interface {
+	forRepository(repository string) Provider
+}
+
+// requestAuthorizer is implemented by providers which have to modify or sign the complete upstream
+// request instead of only setting the Authorization header. It is called after the host and path have been updated.
+type requestAuthorizer interface {
+	authorizeRequest(ctx context.Context, req *http.Request) error
+}
+
 type Authorizer struct {
-	providers        map[string]Provider
-	endpoints        []*Endpoint
-	endpointsByID    map[string]*Endpoint
-	endpointsByToken map[string]*Endpoint
+	mu sync.RWMutex
+	// refreshMu serializes refreshing the repositories and reloading the configuration.
+	refreshMu     sync.Mutex
+	organizations []*organization
+	providers     map[string]Provider
+	endpoints     []*Endpoint
+	endpointsByID map[string]*Endpoint
+	grantsByToken map[string]*Grant
+	// restoredTokens are persisted tokens of endpoints which do not exist yet, keyed by endpoint id and namespace.
+	restoredTokens map[string]string
+	// expiringTokens are previous tokens which are accepted until they expire after a rotation.
+	expiringTokens map[string]time.Time
+	// unwrittenTokens maps the tokens issued by a rotation to the previous tokens of their grants. Previous tokens are
+	// accepted after their grace period until the new token has been written to the secret of the grant.
+	unwrittenTokens map[string]string
+	// namespaceLabels are the labels of all namespaces, which are matched against the namespace selectors.
+	namespaceLabels map[string]map[string]string
+	updated         chan struct{}
+	now             func() time.Time
+}
+
+// PersistedToken is a token which was issued to the namespace of an endpoint by a previous instance of the proxy.
+type PersistedToken struct {
+	ID        string
+	Namespace string
+	Token     string
+}
+
+// organization is a configured organization together with its provider, which is kept to resolve repository patterns.
+type organization struct {
+	cfg      *config.Organization
+	provider Provider
+	patterns []*config.Repository
 }
 
 func NewAuthorizer(cfg *config.Configuration) (*Authorizer, error) {
-	providers := map[string]Provider{}
-	endpoints := []*Endpoint{}
-	endpointsByID := map[string]*Endpoint{}
-	endpointsByToken := map[string]*Endpoint{}
+	authz := &Authorizer{
+		providers:       map[string]Provider{},
+		endpoints:       []*Endpoint{},
+		endpointsByID:   map[string]*Endpoint{},
+		grantsByToken:   map[string]*Grant{},
+		restoredTokens:  map[string]string{},
+		expiringTokens:  map[string]time.Time{},
+		unwrittenTokens: map[string]string{},
+		now:             time.Now,
+		updated:         make(chan struct{}, 1),
+	}
+	apps := githubApps{}
 
 	for _, o := range cfg.Organizations {
-		// Get the correct provider for the organization
-		var provider Provider
-		switch o.Provider {
-		case config.AzureDevOpsProviderType:
-			provider = newAzureDevops(o.AzureDevOps.Pat)
-		case config.GitHubProviderType:
-			pemData, err := b64.URLEncoding.DecodeString(o.GitHub.PrivateKey)
+		provider, err := newProvider(apps, o)
+		if err != nil {
+			return nil, err
+		}
+		org := &organization{
+			cfg:      o,
+			provider: provider,
+		}
+
+		// Create endpoints for the repositories
+		for _, r := range o.Repositories {
+			// Repository patterns are resolved when refreshing the repositories
+			if isRepositoryPattern(r.Name) {
+				if _, ok := provider.(repositoryLister); !ok {
+					return nil, fmt.Errorf("repository pattern %s is not supported by provider %s", r.Name, o.Provider)
+				}
+				if r.SecretNameOverride != "" {
+					return nil, fmt.Errorf("secret name override cannot be used with repository pattern %s", r.Name)
+				}
+				org.patterns = append(org.patterns, r)
+				continue
+			}
+			e, err := newEndpoint(provider, o, r)
 			if err != nil {
 				return nil, err
 			}
-			provider, err = newGithub(o.GitHub.AppID, o.GitHub.InstallationID, pemData)
-			if err != nil {
+			if err := authz.addEndpoint(e, provider); err != nil {
 				return nil, err
 			}
-		default:
-			return nil, fmt.Errorf("invalid provider type %s", o.Provider)
 		}
 
-		// Create endpoints for the repositories
-		for _, r := range o.Repositories {
-			pathRegex, err := provider.getPathRegex(o.Name, r.Project, r.Name)
-			if err != nil {
-				return nil, fmt.Errorf("could not get path regex: %w", err)
+		// Create endpoints which match all repositories in the scopes
+		for _, sc := range o.Scopes {
+			r := &config.Repository{
+				Project:            sc.Project,
+				Name:               anyPathSegment,
+				Namespaces:         sc.Namespaces,
+				NamespaceSelector:  sc.NamespaceSelector,
+				SecretNameOverride: o.GetScopeSecretName(sc),
+				Access:             sc.Access,
+				AllowedRefs:        sc.AllowedRefs,
+				Policy:             sc.Policy,
 			}
-
-			token, err := randomSecureToken()
+			e, err := newEndpoint(provider, o, r)
 			if err != nil {
-				return nil, fmt.Errorf("could not generate random token: %w", err)
+				return nil, err
 			}
-
-			e := &Endpoint{
-				host:         o.Host,
-				scheme:       o.Scheme,
-				organization: o.Name,
-				project:      r.Project,
-				repository:   r.Name,
-				regexes:      pathRegex,
-				Token:        token,
-				Namespaces:   r.Namespaces,
-				SecretName:   o.GetSecretName(r),
+			if err := authz.addEndpoint(e, provider); err != nil {
+				return nil, err
 			}
+		}
+		authz.organizations = append(authz.organizations, org)
+	}
+	return authz, nil
+}
+
+// RepositoryValidator validates repositories which are added to an organization against its provider, so that the
+// provider is only created once when validating many repositories.
+type RepositoryValidator struct {
+	cfg      *config.Organization
+	provider Provider
+}
+
+// NewRepositoryValidator validates the organization, including its own repositories and scopes.
+func NewRepositoryValidator(o *config.Organization) (*RepositoryValidator, error) {
+	authz, err := NewAuthorizer(&config.Configuration{Organizations: []*config.Organization{o}})
+	if err != nil {
+		return nil, err
+	}
+	return &RepositoryValidator{
+		cfg:      o,
+		provider: authz.organizations[0].provider,
+	}, nil
+}
+
+// Validate returns an error if an endpoint cannot be created for the repository.
+func (v *RepositoryValidator) Validate(r *config.Repository) error {
+	if err := config.ValidateRepository(v.cfg, r); err != nil {
+		return err
+	}
+	if isRepositoryPattern(r.Name) {
+		if _, ok := v.provider.(repositoryLister); !ok {
+			return fmt.Errorf("repository pattern %s is not supported by provider %s", r.Name, v.cfg.Provider)
+		}
+		return nil
+	}
+	_, err := newEndpoint(v.provider, v.cfg, r)
+	return err
+}
 
-			providers[e.ID()] = provider
-			endpoints = append(endpoints, e)
-			endpointsByID[e.ID()] = e
-			endpointsByToken[e.Token] = e
+// newProvider returns the correct provider for the organization.
+func newProvider(apps githubApps, o *config.Organization) (Provider, error) {
+	switch o.Provider {
+	case config.AzureDevOpsProviderType:
+		return newAzureDevops(o.AzureDevOps)
+	case config.GitHubProviderType:
+		if o.GitHub.Pat != "" {
+			return newGithubPat(o.GitHub)
 		}
+		app, err := apps.get(o.Scheme, o.Host, o.GitHub.AppID, o.GitHub.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		return newGithub(app, o.Name, o.GitHub)
+	case config.GitLabProviderType:
+		return newGitlab(o.GitLab.Token), nil
+	case config.BitbucketServerProviderType:
+		return newBitbucketServer(o.BitbucketServer.Token), nil
+	case config.BitbucketCloudProviderType:
+		return newBitbucketCloud(o.BitbucketCloud.Token), nil
+	case config.GiteaProviderType:
+		return newGitea(o.Gitea.Token), nil
+	case config.GenericProviderType:
+		return newGeneric(&o.Generic)
+	case config.CodeCommitProviderType:
+		return newCodeCommit(context.Background(), o.Host, o.CodeCommit.Region)
+	default:
+		return nil, fmt.Errorf("invalid provider type %s", o.Provider)
 	}
+}
 
-	authz := &Authorizer{
-		providers:        providers,
-		endpoints:        endpoints,
-		endpointsByID:    endpointsByID,
-		endpointsByToken: endpointsByToken,
+// newEndpoint creates the endpoint of a repository and issues a separate token for each of its namespaces. Grants for
+// namespaces matching the namespace selector are added when the endpoint is added.
+func newEndpoint(provider Provider, o *config.Organization, r *config.Repository) (*Endpoint, error) {
+	pathRegex, err := provider.getPathRegex(o.Name, r.Project, r.Name)
+	if err != nil {
+		return nil, fmt.Errorf("could not get path regex: %w", err)
+	}
+
+	gitRegexes, err := compileGitRequestRegexes(provider.getGitPaths(o.Name, r.Project, r.Name))
+	if err != nil {
+		return nil, fmt.Errorf("could not get git path regex: %w", err)
+	}
+
+	policy, err := newPolicy(provider, o, r)
+	if err != nil {
+		return nil, fmt.Errorf("could not get policy: %w", err)
+	}
+
+	e := &Endpoint{
+		host:         o.Host,
+		scheme:       o.Scheme,
+		organization: o.Name,
+		project:      r.Project,
+		repository:   r.Name,
+		regexes:      pathRegex,
+		gitRegexes:   gitRegexes,
+		policy:       policy,
+		defaults:     r,
+		SecretName:   o.GetSecretName(r),
+	}
+	if r.NamespaceSelector != nil {
+		e.namespaceSelector, err = metav1.LabelSelectorAsSelector(r.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse namespace selector: %w", err)
+		}
+		// The refs are validated here as the grants of selected namespaces are only created later
+		if _, err := parseRefPatterns(r.AllowedRefs); err != nil {
+			return nil, fmt.Errorf("could not parse refs: %w", err)
+		}
+	}
+
+	for _, ns := range r.Namespaces {
+		g, err := newGrant(e, ns)
+		if err != nil {
+			return nil, err
+		}
+		e.Grants = append(e.Grants, g)
+	}
+	return e, nil
+}
+
+// newGrant issues a token for the namespace, settings which are not set for the namespace default to the settings of the repository.
+func newGrant(e *Endpoint, ns *config.Namespace) (*Grant, error) {
+	token, err := randomSecureToken()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate random token: %w", err)
+	}
+	routes, err := parseRoutes(ns.AllowedRoutes, e.organization, e.project, e.repository)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse routes for namespace %s: %w", ns.Name, err)
+	}
+	access := ns.Access
+	if access == "" {
+		access = e.defaults.Access
+	}
+	allowedRefs := ns.AllowedRefs
+	if allowedRefs == nil {
+		allowedRefs = e.defaults.AllowedRefs
+	}
+	refs, err := parseRefPatterns(allowedRefs)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse refs for namespace %s: %w", ns.Name, err)
+	}
+	return &Grant{
+		endpoint:        e,
+		access:          access,
+		routes:          routes,
+		refs:            refs,
+		serviceAccounts: ns.ServiceAccounts,
+		Namespace:       ns.Name,
+		Token:           token,
+	}, nil
+}
+
+// endpointProvider returns the provider which is used for the requests of the endpoint.
+func endpointProvider(e *Endpoint, provider Provider) Provider {
+	// Scopes use the credentials of the organization as they are not limited to a single repository
+	if rp, ok := provider.(repositoryProvider); ok && !e.IsScope() {
+		return rp.forRepository(e.repository)
+	}
+	return provider
+}
+
+// addEndpoint adds the endpoint and its grants, the caller has to hold the lock if the authorizer is in use.
+func (a *Authorizer) addEndpoint(e *Endpoint, provider Provider) error {
+	// The endpoint is not shared yet so the grants of the selected namespaces can be added directly
+	grants, _, err := a.selectNamespaces(e)
+	if err != nil {
+		return fmt.Errorf("could not select namespaces for %s: %w", e.ID(), err)
+	}
+	e.Grants = grants
+	a.providers[e.ID()] = endpointProvider(e, provider)
+	a.endpoints = append(a.endpoints, e)
+	a.endpointsByID[e.ID()] = e
+	for _, g := range e.Grants {
+		a.restoreToken(g)
+		a.grantsByToken[g.Token] = g
+	}
+	return nil
+}
+
+// replaceEndpoint replaces the endpoint with a copy which has different grants, the tokens of the previous grants
+// matching revoke are revoked. The caller has to hold the lock.
+func (a *Authorizer) replaceEndpoint(prev, next *Endpoint, revoke func(g *Grant) bool) int {
+	revoked := 0
+	for token, g := range a.grantsByToken {
+		if g.endpoint.ID() != prev.ID() || !revoke(g) {
+			continue
+		}
+		delete(a.grantsByToken, token)
+		delete(a.expiringTokens, token)
+		revoked++
+	}
+	a.endpoints[slices.Index(a.endpoints, prev)] = next
+	a.endpointsByID[next.ID()] = next
+	for _, g := range next.Grants {
+		a.grantsByToken[g.Token] = g
+	}
+	return revoked
+}
+
+// restoreToken replaces the token of a new grant with a persisted token, the caller has to hold the lock.
+func (a *Authorizer) restoreToken(g *Grant) {
+	key := restoredTokenKey(g.endpoint.ID(), g.Namespace)
+	token, ok := a.restoredTokens[key]
+	if !ok {
+		return
+	}
+	delete(a.restoredTokens, key)
+	if _, used := a.grantsByToken[token]; !used {
+		g.Token = token
+	}
+}
+
+// RestoreTokens replaces the generated tokens with tokens issued before a restart. Tokens of endpoints which do not
+// exist yet, such as repositories matching a pattern, are used when the endpoint is added. It has to be called before
+// any tokens are handed out. Tokens which are empty, already used or conflict with a token restored for the same
+// endpoint and namespace are skipped, the returned error lists the skipped tokens.
+func (a *Authorizer) RestoreTokens(tokens []PersistedToken) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	errs := []error{}
+	restored := map[string]bool{}
+	// Tokens of endpoints which do not exist yet are not in grantsByToken
+	used := map[string]bool{}
+	for _, token := range a.restoredTokens {
+		used[token] = true
+	}
+	for _, t := range tokens {
+		key := restoredTokenKey(t.ID, t.Namespace)
+		switch {
+		case t.Token == "":
+			errs = append(errs, fmt.Errorf("token for %s in namespace %s cannot be empty", t.ID, t.Namespace))
+			continue
+		case restored[key]:
+			errs = append(errs, fmt.Errorf("token for %s in namespace %s has already been restored", t.ID, t.Namespace))
+			continue
+		}
+		if _, ok := a.grantsByToken[t.Token]; ok || used[t.Token] {
+			errs = append(errs, fmt.Errorf("token for %s in namespace %s is already used", t.ID, t.Namespace))
+			continue
+		}
+		restored[key] = true
+		used[t.Token] = true
+		e, ok := a.endpointsByID[t.ID]
+		if !ok {
+			a.restoredTokens[key] = t.Token
+			continue
+		}
+		// Namespaces which are selected by labels receive their grants once the namespaces are known
+		g, err := e.GetGrant(t.Namespace)
+		if err != nil {
+			a.restoredTokens[key] = t.Token
+			continue
+		}
+		delete(a.grantsByToken, g.Token)
+		g.Token = t.Token
+		a.grantsByToken[g.Token] = g
+	}
+	return errors.Join(errs...)
+}
+
+func restoredTokenKey(id, namespace string) string {
+	return id + "/" + namespace
+}
+
+// removeEndpoint removes the endpoint and revokes its grants, the caller has to hold the lock.
+func (a *Authorizer) removeEndpoint(e *Endpoint) {
+	delete(a.providers, e.ID())
+	delete(a.endpointsByID, e.ID())
+	// Previous tokens of rotated grants are removed as well
+	for token, g := range a.grantsByToken {
+		if g.endpoint.ID() == e.ID() {
+			delete(a.grantsByToken, token)
+			delete(a.expiringTokens, token)
+		}
+	}
+	a.endpoints = slices.DeleteFunc(a.endpoints, func(other *Endpoint) bool {
+		return other == e
+	})
+}
+
+// Updated returns a channel which receives a value when endpoints have been added or removed.
+func (a *Authorizer) Updated() <-chan struct{} {
+	return a.updated
+}
+
+func (a *Authorizer) notify() {
+	select {
+	case a.updated <- struct{}{}:
+	default:
 	}
-	return authz, nil
 }
 
 func (a *Authorizer) GetEndpoints() []*Endpoint {
-	return a.endpoints
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Clone(a.endpoints)
 }
 
 //nolint:staticcheck // ignore this
 func (a *Authorizer) GetEndpointById(id string) (*Endpoint, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	e, ok := a.endpointsByID[id]
 	if !ok {
 		return nil, fmt.Errorf("endpoint not found for id %s", id)
@@ -104,11 +450,58 @@ func (a *Authorizer) GetEndpointById(id string) (*Endpoint, error) {
 }
 
 func (a *Authorizer) GetEndpointByToken(token string) (*Endpoint, error) {
-	e, ok := a.endpointsByToken[token]
+	g, err := a.GetGrantByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return g.endpoint, nil
+}
+
+func (a *Authorizer) GetGrantByToken(token string) (*Grant, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	g, ok := a.grantsByToken[token]
 	if !ok {
 		return nil, fmt.Errorf("endpoint not found for given token")
 	}
-	return e, nil
+	if _, ok := a.expiringTokens[token]; ok && a.isTokenExpired(token, a.now()) {
+		return nil, fmt.Errorf("endpoint not found for given token")
+	}
+	return g, nil
+}
+
+// UsesServiceAccounts returns true if any grant can be used by authenticating with a service account token.
+func (a *Authorizer) UsesServiceAccounts() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, e := range a.endpoints {
+		for _, g := range e.Grants {
+			if g.UsesServiceAccounts() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetGrantByServiceAccount returns the grant of the service account for the endpoint matching the path. Grants of repositories
+// are preferred over grants of scopes.
+func (a *Authorizer) GetGrantByServiceAccount(namespace, name, path string) (*Grant, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, scope := range []bool{false, true} {
+		for _, e := range a.endpoints {
+			if e.IsScope() != scope || !e.matchesPath(path) {
+				continue
+			}
+			for _, g := range e.Grants {
+				if g.permitsServiceAccount(namespace, name) {
+					return g, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("service account %s/%s not permitted for path %s", namespace, name, path)
 }
 
 func (a *Authorizer) IsPermitted(path string, token string) error {
@@ -116,20 +509,49 @@ func (a *Authorizer) IsPermitted(path string, token string) error {
 	if err != nil {
 		return err
 	}
-	for _, r := range e.regexes {
-		if r.MatchString(path) {
-			return nil
-		}
+	if e.matchesPath(path) {
+		return nil
 	}
 	return fmt.Errorf("token not permitted for path %s", path)
 }
 
+// IsRequestPermitted checks that the token is permitted to access the path of the request, that the policy
+// of the endpoint permits the request and that the access level and routes of the namespace the token was
+// issued to permit the request.
+func (a *Authorizer) IsRequestPermitted(req *http.Request, token string) error {
+	err := a.IsPermitted(req.URL.EscapedPath(), token)
+	if err != nil {
+		return err
+	}
+	g, err := a.GetGrantByToken(token)
+	if err != nil {
+		return err
+	}
+	if err := isAccessPermitted(g.access, req); err != nil {
+		return err
+	}
+	// Git requests are not limited by the policy and routes, as they only apply to API requests
+	if g.endpoint.isGitRequest(req) {
+		return nil
+	}
+	if err := g.endpoint.policy.evaluate(req); err != nil {
+		return err
+	}
+	// Refs are only checked for pushes, so API requests which could modify refs have to be permitted by a configured policy rule
+	if g.RestrictsRefs() && !isReadRequest(req) && !g.endpoint.policy.allowsExplicitly(req) {
+		return fmt.Errorf("%s %s denied as refs are restricted and no policy rule permits it", req.Method, req.URL.EscapedPath())
+	}
+	return isRoutePermitted(g.routes, req)
+}
+
 func (a *Authorizer) UpdateRequest(ctx context.Context, req *http.Request, token string) (*http.Request, *url.URL, error) {
 	e, err := a.GetEndpointByToken(token)
 	if err != nil {
 		return nil, nil, err
 	}
+	a.mu.RLock()
 	provider, ok := a.providers[e.ID()]
+	a.mu.RUnlock()
 	if !ok {
 		return nil, nil, fmt.Errorf("provider not found for id %s", e.ID())
 	}
@@ -148,6 +570,13 @@ func (a *Authorizer) UpdateRequest(ctx context.Context, req *http.Request, token
 	req.Host = host
 	req.URL.Path = path
 	req.Header.Del("Authorization")
-	req.Header.Add("Authorization", authorizationHeader)
+	if authorizationHeader != "" {
+		req.Header.Add("Authorization", authorizationHeader)
+	}
+	if ra, ok := provider.(requestAuthorizer); ok {
+		if err := ra.authorizeRequest(ctx, req); err != nil {
+			return nil, nil, err
+		}
+	}
 	return req, url, nil
 }
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestRestoreTokens(t *testing.T) {
+	repoSrv := &testRepositoryServer{}
+	repoSrv.setNames("static", "team-a-config")
+	srv := httptest.NewServer(repoSrv)
+	defer srv.Close()
+	authz := getPatternAuthorizer(t, srv)
+	host := srv.Listener.Addr().String()
+
+	static, err := authz.GetEndpointById(host + "-org-proj-static")
+	require.NoError(t, err)
+	generated := static.Grants[0].Token
+
+	err = authz.RestoreTokens([]PersistedToken{
+		{ID: host + "-org-proj-static", Namespace: "static", Token: "static-token"},
+		{ID: host + "-org-proj-static", Namespace: "removed", Token: "removed-token"},
+		{ID: host + "-org-proj-team-a-config", Namespace: "teams", Token: "team-a-token"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "static-token", static.Grants[0].Token)
+	require.NoError(t, authz.IsPermitted("/org/proj/_git/static", "static-token"))
+	require.Error(t, authz.IsPermitted("/org/proj/_git/static", generated))
+	require.Error(t, authz.IsPermitted("/org/proj/_git/static", "removed-token"))
+
+	// Tokens of endpoints resolved from patterns are used once the endpoint is added
+	require.NoError(t, authz.RefreshRepositories(context.TODO()))
+	teamA, err := authz.GetEndpointById(host + "-org-proj-team-a-config")
+	require.NoError(t, err)
+	require.Equal(t, "team-a-token", teamA.Grants[0].Token)
+	require.NoError(t, authz.IsPermitted("/org/proj/_git/team-a-config", "team-a-token"))
+
+	err = authz.RestoreTokens([]PersistedToken{{ID: host + "-org-proj-static", Namespace: "static", Token: "team-a-token"}})
+	require.Error(t, err)
+	err = authz.RestoreTokens([]PersistedToken{{ID: host + "-org-proj-static", Namespace: "static"}})
+	require.Error(t, err)
+	require.Equal(t, "static-token", static.Grants[0].Token)
+
+	// Duplicated and conflicting tokens are skipped without affecting the other tokens
+	err = authz.RestoreTokens([]PersistedToken{
+		{ID: host + "-org-proj-static", Namespace: "static", Token: "first-token"},
+		{ID: host + "-org-proj-static", Namespace: "static", Token: "second-token"},
+		{ID: host + "-org-proj-missing", Namespace: "static", Token: "first-token"},
+		{ID: host + "-org-proj-missing", Namespace: "other", Token: "other-token"},
+	})
+	require.Error(t, err)
+	require.Equal(t, "first-token", static.Grants[0].Token)
+	require.Equal(t, "other-token", authz.restoredTokens[restoredTokenKey(host+"-org-proj-missing", "other")])
+	require.NotContains(t, authz.restoredTokens, restoredTokenKey(host+"-org-proj-missing", "static"))
+}
+
+func TestRepositoryValidator(t *testing.T) {
+	validator, err := NewRepositoryValidator(&config.Organization{
+		Provider:    config.AzureDevOpsProviderType,
+		Host:        "dev.azure.com",
+		Scheme:      "https",
+		Name:        "org",
+		AzureDevOps: config.AzureDevOps{Pat: "pat"},
+		Scopes:      []*config.Scope{},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		repository *config.Repository
+		valid      bool
+	}{
+		{
+			name:       "valid repository",
+			repository: &config.Repository{Project: "proj", Name: "repo", Namespaces: []*config.Namespace{{Name: "foo"}}},
+			valid:      true,
+		},
+		{
+			name:       "invalid access",
+			repository: &config.Repository{Project: "proj", Name: "repo", Namespaces: []*config.Namespace{{Name: "foo", Access: "admin"}}},
+		},
+		{
+			name: "invalid refs",
+			repository: &config.Repository{
+				Project:    "proj",
+				Name:       "repo",
+				Namespaces: []*config.Namespace{{Name: "foo", AllowedRefs: []string{"main"}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.Validate(tt.repository)
+			if !tt.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	_, err = NewRepositoryValidator(&config.Organization{Provider: "unknown", Host: "example.com", Name: "org"})
+	require.Error(t, err)
+}
@@ -4,37 +4,131 @@ import (
 	"context"
 	b64 "encoding/base64"
 	"fmt"
+	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
 )
 
 type azureDevops struct {
-	pat string
+	pat         string
+	tokenSource *entraTokenSource
+	// pathPrefix is the virtual directory of an Azure DevOps Server, the collection is configured as the organization.
+	pathPrefix string
+}
+
+func newAzureDevops(cfg config.AzureDevOps) (*azureDevops, error) {
+	a := &azureDevops{
+		pat:        cfg.Pat,
+		pathPrefix: normalizePathPrefix(cfg.PathPrefix),
+	}
+	if !cfg.Entra.Enabled() {
+		return a, nil
+	}
+	tokenSource, err := newEntraTokenSource(cfg.Entra)
+	if err != nil {
+		return nil, err
+	}
+	a.tokenSource = tokenSource
+	return a, nil
+}
+
+// normalizePathPrefix returns the prefix with a leading slash and without a trailing slash.
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return fmt.Sprintf("/%s", prefix)
 }
 
-func newAzureDevops(pat string) *azureDevops {
-	return &azureDevops{
-		pat: pat,
+// getPrefixRegex returns the regex which has to precede the organization in the path. Paths are anchored when a
+// path prefix is set, but the prefix itself is optional as it is added when forwarding the request.
+func (a *azureDevops) getPrefixRegex() string {
+	if a.pathPrefix == "" {
+		return ""
 	}
+	return fmt.Sprintf("^(%s)?", regexp.QuoteMeta(a.pathPrefix))
 }
 
 //nolint:staticcheck // ignore this
 func (a *azureDevops) getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error) {
-	baseApi, err := regexp.Compile(fmt.Sprintf(`(?i)/%s/_apis\b`, organization))
+	prefix := a.getPrefixRegex()
+	organization = pathSegment(organization)
+	project = pathSegment(project)
+	repository = pathSegment(repository)
+	baseApi, err := regexp.Compile(fmt.Sprintf(`(?i)%s/%s/_apis\b`, prefix, organization))
 	if err != nil {
 		return nil, fmt.Errorf("invalid base api regex: %w", err)
 	}
-	git, err := regexp.Compile(fmt.Sprintf(`(?i)/%s/%s/_git/%s(/.*)?\b`, organization, project, repository))
+	git, err := regexp.Compile(fmt.Sprintf(`(?i)%s/%s/%s/_git/%s(/.*)?\b`, prefix, organization, project, repository))
 	if err != nil {
 		return nil, err
 	}
-	api, err := regexp.Compile(fmt.Sprintf(`(?i)/%s/%s/_apis/git/repositories/%s(/.*)?\b`, organization, project, repository))
+	api, err := regexp.Compile(fmt.Sprintf(`(?i)%s/%s/%s/_apis/git/repositories/%s(/.*)?\b`, prefix, organization, project, repository))
 	if err != nil {
 		return nil, err
 	}
 	return []*regexp.Regexp{baseApi, git, api}, nil
 }
 
+func (a *azureDevops) getGitPaths(organization, project, repository string) []string {
+	path := fmt.Sprintf("/%s/%s/_git/%s", pathSegment(organization), pathSegment(project), pathSegment(repository))
+	if a.pathPrefix == "" {
+		return []string{path}
+	}
+	return []string{fmt.Sprintf("(%s)?%s", regexp.QuoteMeta(a.pathPrefix), path)}
+}
+
+// getDefaultRules limits API requests to the pull requests and commits of the repository, as well as the
+// organization level APIs which are required by clients to discover the API locations.
+func (a *azureDevops) getDefaultRules() []config.PolicyRule {
+	rules := []config.PolicyRule{
+		{
+			Name: "repository-pull-requests",
+			Path: "/{organization}/{project}/_apis/git/repositories/{repository}/pullrequests",
+		},
+		{
+			Name: "repository-commits",
+			Path: "/{organization}/{project}/_apis/git/repositories/{repository}/commits",
+		},
+		{
+			Name:    "repository-read",
+			Methods: []string{http.MethodGet},
+			Path:    "/{organization}/{project}/_apis/git/repositories/{repository}",
+		},
+		{
+			Name:    "resource-areas",
+			Methods: []string{http.MethodGet},
+			Path:    "/{organization}/_apis/ResourceAreas",
+		},
+		{
+			Name:    "api-locations",
+			Methods: []string{http.MethodOptions},
+			Path:    "/{organization}/_apis",
+		},
+	}
+	if a.pathPrefix == "" {
+		return rules
+	}
+	// The path prefix is optional in requests as it is added when forwarding the request
+	for _, rule := range rules {
+		rule.Path = a.pathPrefix + rule.Path
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
 func (a *azureDevops) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
+	if a.tokenSource != nil {
+		token, err := a.tokenSource.Token(ctx)
+		if err != nil {
+			return "", fmt.Errorf("error when fetching Entra ID token: %w", err)
+		}
+		return fmt.Sprintf("Bearer %s", token.AccessToken), nil
+	}
 	tokenB64 := b64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("pat:%s", a.pat)))
 	return fmt.Sprintf("Basic %s", tokenB64), nil
 }
@@ -44,5 +138,29 @@ func (a *azureDevops) getHost(e *Endpoint, path string) string {
 }
 
 func (a *azureDevops) getPath(e *Endpoint, path string) string {
-	return path
+	if a.pathPrefix == "" {
+		return path
+	}
+	if strings.HasPrefix(strings.ToLower(path), strings.ToLower(a.pathPrefix)+"/") {
+		return path
+	}
+	return a.pathPrefix + path
+}
+
+func (a *azureDevops) listRepositories(ctx context.Context, client *apiClient, organization, project string) ([]string, error) {
+	resp := struct {
+		Value []struct {
+			Name string `json:"name"`
+		} `json:"value"`
+	}{}
+	apiPath := fmt.Sprintf("/%s/%s/_apis/git/repositories", url.PathEscape(organization), url.PathEscape(project))
+	err := client.get(ctx, apiPath, url.Values{"api-version": []string{"7.0"}}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, r := range resp.Value {
+		names = append(names, r.Name)
+	}
+	return names, nil
 }
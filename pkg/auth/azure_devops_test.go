@@ -1,9 +1,13 @@
 package auth
 
 import (
+	"context"
+	"net/http"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 
 	"github.com/xenitab/git-auth-proxy/pkg/config"
 )
@@ -17,16 +21,19 @@ func getAzureDevOpsAuthorizer() *Authorizer {
 				Name:     "org",
 				Repositories: []*config.Repository{
 					{
-						Project: "proj",
-						Name:    "repo",
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
 					},
 					{
-						Project: "foobar",
-						Name:    "foobar",
+						Project:    "foobar",
+						Name:       "foobar",
+						Namespaces: []*config.Namespace{{Name: "default"}},
 					},
 					{
-						Project: "proj%20space",
-						Name:    "repo%20space",
+						Project:    "proj%20space",
+						Name:       "repo%20space",
+						Namespaces: []*config.Namespace{{Name: "default"}},
 					},
 				},
 			},
@@ -44,7 +51,7 @@ func TestAzureDevOpsPermitted(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
 	path := "/org/proj/_git/repo"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.NoError(t, err, "token should be permitted")
 }
 
@@ -53,7 +60,7 @@ func TestAzureDevOpsPermittedCaseInsensitive(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
 	path := "/Org/proJ/_git/repo"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.NoError(t, err, "token should be permitted")
 }
 
@@ -62,7 +69,7 @@ func TestAzureDevOpsPermittedExtraPath(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
 	path := "/org/proj/_git/repo/foobar/foobar"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.NoError(t, err, "token should be permitted")
 }
 
@@ -71,7 +78,7 @@ func TestAzureDevOpsWrongOrg(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
 	path := "/org1/proj/_git/repo"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.Error(t, err, "token should not be permitted")
 }
 
@@ -80,7 +87,7 @@ func TestAzureDevOpsToShortPath(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-foobar-foobar")
 	require.NoError(t, err)
 	path := "/foobar/foobar/foobar"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.Error(t, err, "token should not be permitted")
 }
 
@@ -89,7 +96,7 @@ func TestAzureDevOpsWrongProject(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
 	path := "/org/proj1/_git/repo"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.Error(t, err, "token should not be permitted")
 }
 
@@ -98,7 +105,7 @@ func TestAzureDevOpsWrongRepo(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
 	path := "/org/proj/_git/repo123"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.Error(t, err, "token should not be permitted")
 }
 
@@ -115,7 +122,7 @@ func TestAzureDevOpsWhitespace(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj%20space-repo%20space")
 	require.NoError(t, err)
 	path := "/org/proj%20space/_git/repo%20space"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.NoError(t, err, "token should be permitted")
 }
 
@@ -124,7 +131,7 @@ func TestAzureDevOpsBaseApi(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
 	path := "/org/_apis"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.NoError(t, err, "token should be permitted")
 }
 
@@ -133,6 +140,102 @@ func TestAzureDevOpsApiPath(t *testing.T) {
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
 	path := "/org/proj/_apis/git/repositories/repo/commits"
-	err = authz.IsPermitted(path, endpoint.Token)
+	err = authz.IsPermitted(path, endpoint.Grants[0].Token)
 	require.NoError(t, err, "token should be permitted")
 }
+
+func TestAzureDevOpsGetAuthorization(t *testing.T) {
+	pat := &azureDevops{pat: "foo"}
+	authorization, err := pat.getAuthorizationHeader(context.TODO(), "/org/proj/_git/repo")
+	require.NoError(t, err)
+	require.Equal(t, "Basic cGF0OmZvbw==", authorization)
+
+	entra := &azureDevops{tokenSource: &entraTokenSource{token: &oauth2.Token{AccessToken: "foo"}}}
+	authorization, err = entra.getAuthorizationHeader(context.TODO(), "/org/proj/_git/repo")
+	require.NoError(t, err)
+	require.Equal(t, "Bearer foo", authorization)
+}
+
+func TestAzureDevOpsServerPathPrefix(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				AzureDevOps: config.AzureDevOps{
+					Pat:        "foo",
+					PathPrefix: "/tfs/",
+				},
+				Host:   "tfs.example.com",
+				Scheme: "https",
+				Name:   "DefaultCollection",
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	endpoint, err := authz.GetEndpointById("tfs.example.com-DefaultCollection-proj-repo")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		path         string
+		allow        bool
+		expectedPath string
+	}{
+		{
+			name:         "git with prefix",
+			path:         "/tfs/DefaultCollection/proj/_git/repo/info/refs",
+			allow:        true,
+			expectedPath: "/tfs/DefaultCollection/proj/_git/repo/info/refs",
+		},
+		{
+			name:         "git without prefix",
+			path:         "/DefaultCollection/proj/_git/repo",
+			allow:        true,
+			expectedPath: "/tfs/DefaultCollection/proj/_git/repo",
+		},
+		{
+			name:         "api with prefix",
+			path:         "/TFS/defaultcollection/proj/_apis/git/repositories/repo/commits",
+			allow:        true,
+			expectedPath: "/TFS/defaultcollection/proj/_apis/git/repositories/repo/commits",
+		},
+		{
+			name:         "base api without prefix",
+			path:         "/DefaultCollection/_apis",
+			allow:        true,
+			expectedPath: "/tfs/DefaultCollection/_apis",
+		},
+		{
+			name:  "wrong virtual directory",
+			path:  "/foo/DefaultCollection/proj/_git/repo",
+			allow: false,
+		},
+		{
+			name:  "wrong collection",
+			path:  "/tfs/OtherCollection/proj/_git/repo",
+			allow: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authz.IsPermitted(tt.path, endpoint.Grants[0].Token)
+			if !tt.allow {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			req := &http.Request{Header: http.Header{}, URL: &url.URL{Path: tt.path}}
+			req, _, err = authz.UpdateRequest(context.TODO(), req, endpoint.Grants[0].Token)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedPath, req.URL.Path)
+		})
+	}
+}
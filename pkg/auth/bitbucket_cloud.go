@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	standardBitbucketCloud  = "bitbucket.org"
+	bitbucketCloudApiPrefix = "/2.0/"
+	bitbucketCloudPageSize  = 100
+)
+
+type bitbucketCloud struct {
+	token string
+}
+
+func newBitbucketCloud(token string) *bitbucketCloud {
+	return &bitbucketCloud{
+		token: token,
+	}
+}
+
+// getPathRegex expects the organization to be the workspace which owns the repository.
+func (b *bitbucketCloud) getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error) {
+	organization = pathSegment(organization)
+	repository = pathSegment(repository)
+	git, err := regexp.Compile(fmt.Sprintf(`(?i)^/%s/%s(\.git)?(/.*)?$`, organization, repository))
+	if err != nil {
+		return nil, err
+	}
+	api, err := regexp.Compile(fmt.Sprintf(`(?i)^/2\.0/repositories/%s/%s(/.*)?$`, organization, repository))
+	if err != nil {
+		return nil, err
+	}
+	return []*regexp.Regexp{git, api}, nil
+}
+
+func (b *bitbucketCloud) getGitPaths(organization, project, repository string) []string {
+	return []string{fmt.Sprintf("/%s/%s", pathSegment(organization), pathSegment(repository))}
+}
+
+func (b *bitbucketCloud) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
+	if strings.HasPrefix(path, bitbucketCloudApiPrefix) {
+		return fmt.Sprintf("Bearer %s", b.token), nil
+	}
+	tokenB64 := b64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("x-token-auth:%s", b.token)))
+	return fmt.Sprintf("Basic %s", tokenB64), nil
+}
+
+func (b *bitbucketCloud) getHost(e *Endpoint, path string) string {
+	if e.host != standardBitbucketCloud {
+		return e.host
+	}
+	if strings.HasPrefix(path, bitbucketCloudApiPrefix) {
+		return fmt.Sprintf("api.%s", e.host)
+	}
+	return e.host
+}
+
+func (b *bitbucketCloud) getPath(e *Endpoint, path string) string {
+	return path
+}
+
+func (b *bitbucketCloud) listRepositories(ctx context.Context, client *apiClient, organization, project string) ([]string, error) {
+	names := []string{}
+	for page := 1; ; page++ {
+		resp := struct {
+			Values []struct {
+				Slug string `json:"slug"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}{}
+		query := url.Values{"pagelen": []string{strconv.Itoa(bitbucketCloudPageSize)}, "page": []string{strconv.Itoa(page)}}
+		err := client.get(ctx, fmt.Sprintf("/2.0/repositories/%s", url.PathEscape(organization)), query, &resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Values {
+			names = append(names, r.Slug)
+		}
+		if resp.Next == "" {
+			return names, nil
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func getBitbucketCloudAuthorizer() *Authorizer {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.BitbucketCloudProviderType,
+				BitbucketCloud: config.BitbucketCloud{
+					Token: "foo",
+				},
+				Host: standardBitbucketCloud,
+				Name: "workspace",
+				Repositories: []*config.Repository{
+					{
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	auth, err := NewAuthorizer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return auth
+}
+
+func TestBitbucketCloudAuthorization(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected bool
+	}{
+		{
+			name:     "allow repo",
+			path:     "/workspace/repo.git/info/refs",
+			expected: true,
+		},
+		{
+			name:     "allow api",
+			path:     "/2.0/repositories/workspace/repo/pullrequests",
+			expected: true,
+		},
+		{
+			name:     "disallow wrong workspace",
+			path:     "/foo/repo.git",
+			expected: false,
+		},
+		{
+			name:     "disallow wrong repo in api",
+			path:     "/2.0/repositories/workspace/foo",
+			expected: false,
+		},
+		{
+			name:     "disallow workspace api",
+			path:     "/2.0/repositories/workspace",
+			expected: false,
+		},
+	}
+	authz := getBitbucketCloudAuthorizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := authz.GetEndpointById("bitbucket.org-workspace-repo")
+			require.NoError(t, err)
+			err = authz.IsPermitted(tt.path, endpoint.Grants[0].Token)
+			if tt.expected {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestBitbucketCloudGetAuthorization(t *testing.T) {
+	bb := newBitbucketCloud("foo")
+	authorization, err := bb.getAuthorizationHeader(context.TODO(), "/2.0/repositories/workspace/repo")
+	require.NoError(t, err)
+	require.Equal(t, "Bearer foo", authorization)
+	authorization, err = bb.getAuthorizationHeader(context.TODO(), "/workspace/repo.git")
+	require.NoError(t, err)
+	require.Equal(t, "Basic eC10b2tlbi1hdXRoOmZvbw==", authorization)
+}
+
+func TestBitbucketCloudGetHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "api path standard bitbucket",
+			host:     standardBitbucketCloud,
+			path:     "/2.0/repositories/workspace/repo",
+			expected: "api.bitbucket.org",
+		},
+		{
+			name:     "repo path standard bitbucket",
+			host:     standardBitbucketCloud,
+			path:     "/workspace/repo.git",
+			expected: standardBitbucketCloud,
+		},
+		{
+			name:     "api path other host",
+			host:     "example.com",
+			path:     "/2.0/repositories/workspace/repo",
+			expected: "example.com",
+		},
+	}
+	bb := newBitbucketCloud("foo")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Endpoint{
+				host: tt.host,
+			}
+			host := bb.getHost(e, tt.path)
+			require.Equal(t, tt.expected, host)
+		})
+	}
+}
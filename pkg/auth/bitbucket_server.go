@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+const bitbucketServerPageSize = 100
+
+type bitbucketServer struct {
+	token string
+}
+
+func newBitbucketServer(token string) *bitbucketServer {
+	return &bitbucketServer{
+		token: token,
+	}
+}
+
+// getPathRegex ignores the organization as Bitbucket Server paths only contain the project key and repository slug.
+func (b *bitbucketServer) getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error) {
+	if project == "" {
+		return nil, fmt.Errorf("project key is required for Bitbucket Server repository %s", repository)
+	}
+	project = pathSegment(project)
+	repository = pathSegment(repository)
+	git, err := regexp.Compile(fmt.Sprintf(`(?i)^/scm/%s/%s(\.git)?(/.*)?$`, project, repository))
+	if err != nil {
+		return nil, err
+	}
+	api, err := regexp.Compile(fmt.Sprintf(`(?i)^/rest/api/1\.0/projects/%s/repos/%s(/.*)?$`, project, repository))
+	if err != nil {
+		return nil, err
+	}
+	return []*regexp.Regexp{git, api}, nil
+}
+
+func (b *bitbucketServer) getGitPaths(organization, project, repository string) []string {
+	return []string{fmt.Sprintf("/scm/%s/%s", pathSegment(project), pathSegment(repository))}
+}
+
+// getAuthorizationHeader uses the same header for git and API requests as HTTP access tokens are accepted as bearer tokens by both.
+func (b *bitbucketServer) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
+	return fmt.Sprintf("Bearer %s", b.token), nil
+}
+
+func (b *bitbucketServer) getHost(e *Endpoint, path string) string {
+	return e.host
+}
+
+func (b *bitbucketServer) getPath(e *Endpoint, path string) string {
+	return path
+}
+
+func (b *bitbucketServer) listRepositories(ctx context.Context, client *apiClient, organization, project string) ([]string, error) {
+	names := []string{}
+	start := 0
+	for {
+		resp := struct {
+			Values []struct {
+				Slug string `json:"slug"`
+			} `json:"values"`
+			IsLastPage    bool `json:"isLastPage"`
+			NextPageStart int  `json:"nextPageStart"`
+		}{}
+		query := url.Values{"start": []string{strconv.Itoa(start)}, "limit": []string{strconv.Itoa(bitbucketServerPageSize)}}
+		err := client.get(ctx, fmt.Sprintf("/rest/api/1.0/projects/%s/repos", url.PathEscape(project)), query, &resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Values {
+			names = append(names, r.Slug)
+		}
+		if resp.IsLastPage {
+			return names, nil
+		}
+		start = resp.NextPageStart
+	}
+}
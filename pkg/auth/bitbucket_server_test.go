@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func getBitbucketServerAuthorizer() *Authorizer {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.BitbucketServerProviderType,
+				BitbucketServer: config.BitbucketServer{
+					Token: "foo",
+				},
+				Host: "bitbucket.example.com",
+				Name: "org",
+				Repositories: []*config.Repository{
+					{
+						Project:    "PROJ",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	auth, err := NewAuthorizer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return auth
+}
+
+func TestBitbucketServerAuthorization(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected bool
+	}{
+		{
+			name:     "allow repo",
+			path:     "/scm/PROJ/repo.git/info/refs",
+			expected: true,
+		},
+		{
+			name:     "allow repo case insensitive",
+			path:     "/scm/proj/Repo.git",
+			expected: true,
+		},
+		{
+			name:     "allow api",
+			path:     "/rest/api/1.0/projects/PROJ/repos/repo/pull-requests",
+			expected: true,
+		},
+		{
+			name:     "disallow wrong project",
+			path:     "/scm/FOO/repo.git",
+			expected: false,
+		},
+		{
+			name:     "disallow wrong repo",
+			path:     "/scm/PROJ/repo1.git",
+			expected: false,
+		},
+		{
+			name:     "disallow wrong repo in api",
+			path:     "/rest/api/1.0/projects/PROJ/repos/foo",
+			expected: false,
+		},
+		{
+			name:     "disallow project api",
+			path:     "/rest/api/1.0/projects/PROJ",
+			expected: false,
+		},
+	}
+	authz := getBitbucketServerAuthorizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := authz.GetEndpointById("bitbucket.example.com-org-PROJ-repo")
+			require.NoError(t, err)
+			err = authz.IsPermitted(tt.path, endpoint.Grants[0].Token)
+			if tt.expected {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestBitbucketServerMissingProject(t *testing.T) {
+	bb := newBitbucketServer("foo")
+	_, err := bb.getPathRegex("org", "", "repo")
+	require.Error(t, err)
+}
+
+func TestBitbucketServerGetAuthorization(t *testing.T) {
+	bb := newBitbucketServer("foo")
+	authorization, err := bb.getAuthorizationHeader(context.TODO(), "/scm/PROJ/repo.git")
+	require.NoError(t, err)
+	require.Equal(t, "Bearer foo", authorization)
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+const (
+	codeCommitService       = "codecommit"
+	codeCommitTimeFormat    = "20060102T150405"
+	codeCommitHostPrefix    = "git-codecommit"
+	codeCommitSigningMethod = "GIT"
+)
+
+var codeCommitRepoPathRegex = regexp.MustCompile(`^/v1/repos/[^/]+`)
+
+// codeCommit signs requests in the same way as the AWS CodeCommit credential helper. The password is a SigV4
+// signature over the repository path and host, which means that a new password is computed for every request.
+type codeCommit struct {
+	region      string
+	credentials aws.CredentialsProvider
+	now         func() time.Time
+}
+
+func newCodeCommit(ctx context.Context, host, region string) (*codeCommit, error) {
+	if region == "" {
+		region = getCodeCommitRegion(host)
+	}
+	if region == "" {
+		return nil, fmt.Errorf("could not determine CodeCommit region from host %s", host)
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("could not load AWS configuration: %w", err)
+	}
+	return &codeCommit{
+		region:      region,
+		credentials: cfg.Credentials,
+		now:         time.Now,
+	}, nil
+}
+
+// getCodeCommitRegion parses the region from hosts in the format git-codecommit.<region>.amazonaws.com.
+func getCodeCommitRegion(host string) string {
+	comps := strings.Split(host, ".")
+	if len(comps) < 3 || !strings.HasPrefix(comps[0], codeCommitHostPrefix) {
+		return ""
+	}
+	return comps[1]
+}
+
+func (c *codeCommit) getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error) {
+	git, err := regexp.Compile(fmt.Sprintf(`^/v1/repos/%s(/.*)?$`, pathSegment(repository)))
+	if err != nil {
+		return nil, err
+	}
+	return []*regexp.Regexp{git}, nil
+}
+
+func (c *codeCommit) getGitPaths(organization, project, repository string) []string {
+	return []string{fmt.Sprintf("/v1/repos/%s", pathSegment(repository))}
+}
+
+// getAuthorizationHeader returns an empty header as the request is signed in authorizeRequest.
+func (c *codeCommit) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
+	return "", nil
+}
+
+func (c *codeCommit) authorizeRequest(ctx context.Context, req *http.Request) error {
+	repoPath := codeCommitRepoPathRegex.FindString(req.URL.Path)
+	if repoPath == "" {
+		return fmt.Errorf("could not get repository from path %s", req.URL.Path)
+	}
+	creds, err := c.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("could not retrieve AWS credentials: %w", err)
+	}
+	username := creds.AccessKeyID
+	if creds.SessionToken != "" {
+		username = fmt.Sprintf("%s%%%s", creds.AccessKeyID, creds.SessionToken)
+	}
+	password := c.sign(req.Host, repoPath, creds.SecretAccessKey, c.now().UTC())
+	tokenB64 := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))
+	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", tokenB64))
+	return nil
+}
+
+func (c *codeCommit) sign(host, path, secretAccessKey string, now time.Time) string {
+	timestamp := now.Format(codeCommitTimeFormat)
+	date := timestamp[:8]
+	canonicalRequest := fmt.Sprintf("%s\n%s\n\nhost:%s\n\nhost\n", codeCommitSigningMethod, path, host)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, c.region, codeCommitService)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", timestamp, scope, hex.EncodeToString(canonicalHash[:]))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, codeCommitService)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return fmt.Sprintf("%sZ%s", timestamp, signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (c *codeCommit) getHost(e *Endpoint, path string) string {
+	return e.host
+}
+
+func (c *codeCommit) getPath(e *Endpoint, path string) string {
+	return path
+}
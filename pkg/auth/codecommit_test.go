@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/require"
+)
+
+const codeCommitHost = "git-codecommit.eu-west-1.amazonaws.com"
+
+func getCodeCommitAuthorizer(sessionToken string) *Authorizer {
+	cc := &codeCommit{
+		region: "eu-west-1",
+		credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "access", SecretAccessKey: "secret", SessionToken: sessionToken}, nil
+		}),
+		now: func() time.Time {
+			return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		},
+	}
+	regexes, err := cc.getPathRegex("account", "", "repo")
+	if err != nil {
+		panic(err)
+	}
+	e := &Endpoint{
+		scheme:       "https",
+		host:         codeCommitHost,
+		organization: "account",
+		repository:   "repo",
+		regexes:      regexes,
+	}
+	g := &Grant{endpoint: e, Namespace: "default", Token: "token"}
+	e.Grants = []*Grant{g}
+	return &Authorizer{
+		providers:     map[string]Provider{e.ID(): cc},
+		endpoints:     []*Endpoint{e},
+		endpointsByID: map[string]*Endpoint{e.ID(): e},
+		grantsByToken: map[string]*Grant{g.Token: g},
+	}
+}
+
+func TestCodeCommitAuthorization(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected bool
+	}{
+		{
+			name:     "allow repo",
+			path:     "/v1/repos/repo/info/refs",
+			expected: true,
+		},
+		{
+			name:     "disallow wrong repo",
+			path:     "/v1/repos/foo/info/refs",
+			expected: false,
+		},
+		{
+			name:     "disallow repo with prefix",
+			path:     "/v1/repos/repo-foo",
+			expected: false,
+		},
+	}
+	authz := getCodeCommitAuthorizer("")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authz.IsPermitted(tt.path, "token")
+			if tt.expected {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCodeCommitSignRequest(t *testing.T) {
+	tests := []struct {
+		name             string
+		sessionToken     string
+		expectedUsername string
+	}{
+		{
+			name:             "static credentials",
+			expectedUsername: "access",
+		},
+		{
+			name:             "session credentials",
+			sessionToken:     "session",
+			expectedUsername: "access%session",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authz := getCodeCommitAuthorizer(tt.sessionToken)
+			req := &http.Request{Header: http.Header{}, URL: &url.URL{Path: "/v1/repos/repo/info/refs"}}
+			req.Header.Set("Authorization", "Bearer token")
+			req, _, err := authz.UpdateRequest(context.TODO(), req, "token")
+			require.NoError(t, err)
+			require.Equal(t, codeCommitHost, req.Host)
+
+			authorization := req.Header.Get("Authorization")
+			require.True(t, strings.HasPrefix(authorization, "Basic "))
+			decoded, err := b64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "Basic "))
+			require.NoError(t, err)
+			comps := strings.SplitN(string(decoded), ":", 2)
+			require.Equal(t, tt.expectedUsername, comps[0])
+			require.Equal(t, "20240102T030405Zcdeaedd5b9a3ab724456933117a78c28270a5ff9c8a76dc4bcf73510c6e63d22", comps[1])
+		})
+	}
+}
+
+func TestCodeCommitRegion(t *testing.T) {
+	require.Equal(t, "eu-west-1", getCodeCommitRegion(codeCommitHost))
+	require.Equal(t, "us-east-1", getCodeCommitRegion("git-codecommit-fips.us-east-1.amazonaws.com"))
+	require.Equal(t, "", getCodeCommitRegion("example.com"))
+	require.Equal(t, "/v1/repos/repo", codeCommitRepoPathRegex.FindString("/v1/repos/repo/info/refs"))
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+// UpdateCredentials replaces the configuration of the organizations whose credentials have changed. Only the providers
+// of the organizations are created again, the endpoints and tokens are kept as they do not depend on the credentials.
+// Organizations which are not part of the configuration are left unchanged.
+func (a *Authorizer) UpdateCredentials(cfg *config.Configuration) error {
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+
+	a.mu.RLock()
+	orgs := slices.Clone(a.organizations)
+	a.mu.RUnlock()
+
+	apps := githubApps{}
+	changed := []*organization{}
+	for i, org := range orgs {
+		idx := slices.IndexFunc(cfg.Organizations, func(o *config.Organization) bool {
+			return o.Host == org.cfg.Host && o.Name == org.cfg.Name
+		})
+		if idx < 0 || reflect.DeepEqual(cfg.Organizations[idx], org.cfg) {
+			continue
+		}
+		o := cfg.Organizations[idx]
+		provider, err := newProvider(apps, o)
+		if err != nil {
+			return fmt.Errorf("could not update credentials of organization %s: %w", o.Name, err)
+		}
+		orgs[i] = &organization{
+			cfg:      o,
+			provider: provider,
+			patterns: org.patterns,
+		}
+		changed = append(changed, orgs[i])
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, org := range changed {
+		for _, e := range a.endpoints {
+			if e.host == org.cfg.Host && e.organization == org.cfg.Name {
+				a.providers[e.ID()] = endpointProvider(e, org.provider)
+			}
+		}
+	}
+	a.organizations = orgs
+	return nil
+}
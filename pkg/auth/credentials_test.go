@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func getCredentialsConfig(pat string) *config.Configuration {
+	return &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider:    config.AzureDevOpsProviderType,
+				Host:        "dev.azure.com",
+				Scheme:      "https",
+				Name:        "org",
+				AzureDevOps: config.AzureDevOps{Pat: pat},
+				Repositories: []*config.Repository{
+					{Project: "proj", Name: "repo", Namespaces: []*config.Namespace{{Name: "foo"}}},
+				},
+			},
+		},
+	}
+}
+
+func TestUpdateCredentials(t *testing.T) {
+	authz, err := NewAuthorizer(getCredentialsConfig("pat"))
+	require.NoError(t, err)
+	e, err := authz.GetEndpointById("dev.azure.com-org-proj-repo")
+	require.NoError(t, err)
+	token := e.Grants[0].Token
+	getAuthorization := func() string {
+		req := &http.Request{URL: &url.URL{Path: "/org/proj/_git/repo"}, Header: http.Header{}}
+		req, _, err := authz.UpdateRequest(context.TODO(), req, token)
+		require.NoError(t, err)
+		return req.Header.Get("Authorization")
+	}
+	require.Equal(t, "Basic "+b64.URLEncoding.EncodeToString([]byte("pat:pat")), getAuthorization())
+
+	// Unchanged credentials do not notify or replace the providers
+	require.NoError(t, authz.UpdateCredentials(getCredentialsConfig("pat")))
+	require.Empty(t, authz.Updated())
+
+	// Endpoints and tokens are kept while the new credentials are used
+	require.NoError(t, authz.UpdateCredentials(getCredentialsConfig("rotated")))
+	require.Equal(t, "Basic "+b64.URLEncoding.EncodeToString([]byte("pat:rotated")), getAuthorization())
+	updated, err := authz.GetEndpointById("dev.azure.com-org-proj-repo")
+	require.NoError(t, err)
+	require.Same(t, e, updated)
+	require.Empty(t, authz.Updated())
+
+	// Organizations which cannot be created keep their previous credentials
+	cfg := getCredentialsConfig("rotated")
+	cfg.Organizations[0].Provider = "unknown"
+	require.Error(t, authz.UpdateCredentials(cfg))
+	require.Equal(t, "Basic "+b64.URLEncoding.EncodeToString([]byte("pat:rotated")), getAuthorization())
+}
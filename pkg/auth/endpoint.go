@@ -1,8 +1,14 @@
 package auth
 
 import (
+	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
 )
 
 type Endpoint struct {
@@ -12,12 +18,95 @@ type Endpoint struct {
 	project      string
 	repository   string
 	regexes      []*regexp.Regexp
+	// gitRegexes match the git requests of the repository, which are not limited by the policy.
+	gitRegexes []*regexp.Regexp
+	policy     *policy
+	// source is the repository pattern which the endpoint was resolved from, it is nil for configured repositories.
+	source *config.Repository
+	// defaults are the settings of the repository which are used for namespaces without their own settings.
+	defaults *config.Repository
+	// namespaceSelector selects the namespaces which are given access in addition to the configured namespaces.
+	namespaceSelector labels.Selector
 
-	Token      string
-	Namespaces []string
+	Grants     []*Grant
 	SecretName string
 }
 
+// Grant is the access given to a single namespace for an endpoint. Every grant has its own token so that
+// a token can be traced back to the namespace it was issued to.
+type Grant struct {
+	endpoint *Endpoint
+	access   config.AccessLevel
+	routes   []*route
+	refs     []*refPattern
+	// serviceAccounts which can authenticate as the grant with their service account token.
+	serviceAccounts []string
+	// selected is true if the namespace was selected by the namespace selector of the endpoint.
+	selected bool
+
+	Namespace string
+	Token     string
+}
+
+// Endpoint returns the endpoint which the grant gives access to.
+func (g *Grant) Endpoint() *Endpoint {
+	return g.endpoint
+}
+
+// UsesServiceAccounts returns true if the grant is used by authenticating with service account tokens, in which case
+// its token should not be written to a secret.
+func (g *Grant) UsesServiceAccounts() bool {
+	return len(g.serviceAccounts) > 0
+}
+
+func (g *Grant) permitsServiceAccount(namespace, name string) bool {
+	if g.Namespace != namespace {
+		return false
+	}
+	for _, sa := range g.serviceAccounts {
+		if sa == anyServiceAccount || sa == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetGrant returns the grant of the namespace.
+func (e *Endpoint) GetGrant(namespace string) (*Grant, error) {
+	for _, g := range e.Grants {
+		if g.Namespace == namespace {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("grant not found for namespace %s in endpoint %s", namespace, e.ID())
+}
+
+// IsScope returns true if the endpoint gives access to all repositories in an organization or project.
+func (e *Endpoint) IsScope() bool {
+	return e.repository == anyPathSegment
+}
+
+func (e *Endpoint) matchesPath(path string) bool {
+	for _, r := range e.regexes {
+		if r.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGitRequest checks if the request is part of the git smart HTTP or LFS protocol of the repository rather than an API
+// request. API paths which end with the same paths as git requests are not git requests.
+func (e *Endpoint) isGitRequest(req *http.Request) bool {
+	path := req.URL.EscapedPath()
+	for _, r := range e.gitRegexes {
+		if r.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Endpoint) ID() string {
 	comps := []string{e.host, e.organization}
 	if e.project != "" {
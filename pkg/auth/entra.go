@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+const (
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+	// azureDevOpsScope is the scope of the Azure DevOps resource, which is the same for all organizations.
+	azureDevOpsScope = "499b84ac-1321-427f-aa17-267ca6975798/.default"
+	// entraEarlyExpiry makes sure that tokens are refreshed before they expire while a request is in flight.
+	entraEarlyExpiry = 5 * time.Minute
+	// entraRequestTimeout limits how long a token exchange can block the request which needs the token.
+	entraRequestTimeout   = 30 * time.Second
+	clientAssertionType   = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	tenantIDEnvKey        = "AZURE_TENANT_ID"
+	clientIDEnvKey        = "AZURE_CLIENT_ID"
+	federatedTokenFileKey = "AZURE_FEDERATED_TOKEN_FILE"
+	authorityHostEnvKey   = "AZURE_AUTHORITY_HOST"
+)
+
+// newEntraTokenSource returns a token source for the Azure DevOps resource which caches the token until shortly before it expires.
+func newEntraTokenSource(cfg config.Entra) (*entraTokenSource, error) {
+	tenantID := cfg.TenantID
+	clientID := cfg.ClientID
+	authorityHost := cfg.AuthorityHost
+	tokenFile := ""
+	if cfg.WorkloadIdentity {
+		tenantID = valueOrEnv(tenantID, tenantIDEnvKey)
+		clientID = valueOrEnv(clientID, clientIDEnvKey)
+		authorityHost = valueOrEnv(authorityHost, authorityHostEnvKey)
+		tokenFile = os.Getenv(federatedTokenFileKey)
+		if tokenFile == "" {
+			return nil, fmt.Errorf("workload identity requires the environment variable %s to be set", federatedTokenFileKey)
+		}
+	}
+	if tenantID == "" || clientID == "" {
+		return nil, errors.New("tenant ID and client ID are required for Entra ID authentication")
+	}
+	if tokenFile == "" && cfg.ClientSecret == "" {
+		return nil, errors.New("either a client secret or workload identity is required for Entra ID authentication")
+	}
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+
+	ccCfg := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: cfg.ClientSecret,
+		TokenURL:     fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authorityHost, "/"), tenantID),
+		Scopes:       []string{azureDevOpsScope},
+		AuthStyle:    oauth2.AuthStyleInParams,
+	}
+	return &entraTokenSource{
+		cfg:        ccCfg,
+		tokenFile:  tokenFile,
+		httpClient: &http.Client{Timeout: entraRequestTimeout},
+		now:        time.Now,
+	}, nil
+}
+
+// entraTokenSource caches the Entra ID token until shortly before it expires. Tokens are fetched with the context of
+// the request which needs them, so that a request is not blocked longer than its own deadline.
+type entraTokenSource struct {
+	cfg clientcredentials.Config
+	// tokenFile is the Kubernetes service account token which is exchanged when using workload identity. It is read for
+	// every exchange as it is rotated by the kubelet.
+	tokenFile  string
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (e *entraTokenSource) Token(ctx context.Context) (*oauth2.Token, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != nil && (e.token.Expiry.IsZero() || e.token.Expiry.Sub(e.now()) > entraEarlyExpiry) {
+		return e.token, nil
+	}
+	cfg := e.cfg
+	if e.tokenFile != "" {
+		assertion, err := os.ReadFile(e.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read federated token file: %w", err)
+		}
+		cfg.EndpointParams = url.Values{
+			"client_assertion_type": []string{clientAssertionType},
+			"client_assertion":      []string{strings.TrimSpace(string(assertion))},
+		}
+	}
+	token, err := cfg.Token(context.WithValue(ctx, oauth2.HTTPClient, e.httpClient))
+	if err != nil {
+		return nil, err
+	}
+	e.token = token
+	return token, nil
+}
+
+func valueOrEnv(value, key string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
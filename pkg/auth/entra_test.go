@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func newEntraTestServer(t *testing.T, expected map[string]string) (*httptest.Server, *int32) {
+	t.Helper()
+	requests := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for k, v := range expected {
+			if r.PostForm.Get(k) != v {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		//nolint:errcheck // ignore
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "entra-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestEntraClientSecret(t *testing.T) {
+	srv, requests := newEntraTestServer(t, map[string]string{
+		"grant_type":    "client_credentials",
+		"client_id":     "client",
+		"client_secret": "secret",
+		"scope":         azureDevOpsScope,
+	})
+	src, err := newEntraTokenSource(config.Entra{
+		TenantID:      "tenant",
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		AuthorityHost: srv.URL,
+	})
+	require.NoError(t, err)
+	token, err := src.Token(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, "entra-token", token.AccessToken)
+
+	// The token should be cached until it expires
+	_, err = src.Token(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestEntraWorkloadIdentity(t *testing.T) {
+	srv, _ := newEntraTestServer(t, map[string]string{
+		"grant_type":            "client_credentials",
+		"client_id":             "client",
+		"client_assertion_type": clientAssertionType,
+		"client_assertion":      "federated-token",
+	})
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("federated-token\n"), 0o600))
+	t.Setenv(tenantIDEnvKey, "tenant")
+	t.Setenv(clientIDEnvKey, "client")
+	t.Setenv(federatedTokenFileKey, tokenFile)
+	t.Setenv(authorityHostEnvKey, srv.URL)
+
+	src, err := newEntraTokenSource(config.Entra{WorkloadIdentity: true})
+	require.NoError(t, err)
+	token, err := src.Token(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, "entra-token", token.AccessToken)
+}
+
+func TestEntraRequestContext(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+	src, err := newEntraTokenSource(config.Entra{
+		TenantID:      "tenant",
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		AuthorityHost: srv.URL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, entraRequestTimeout, src.httpClient.Timeout)
+
+	// A hung token endpoint should not block the request longer than its deadline
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	_, err = src.Token(ctx)
+	require.Error(t, err)
+}
+
+func TestEntraInvalidConfiguration(t *testing.T) {
+	_, err := newEntraTokenSource(config.Entra{ClientID: "client", ClientSecret: "secret"})
+	require.Error(t, err)
+	_, err = newEntraTokenSource(config.Entra{TenantID: "tenant", ClientID: "client"})
+	require.Error(t, err)
+	t.Setenv(federatedTokenFileKey, "")
+	_, err = newEntraTokenSource(config.Entra{TenantID: "tenant", ClientID: "client", WorkloadIdentity: true})
+	require.Error(t, err)
+}
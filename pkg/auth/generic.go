@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+const (
+	organizationPlaceholder = "{organization}"
+	projectPlaceholder      = config.GenericProjectPlaceholder
+	repositoryPlaceholder   = "{repository}"
+)
+
+// generic is a provider which is configured through path templates instead of having hardcoded paths.
+type generic struct {
+	cfg *config.Generic
+}
+
+func newGeneric(cfg *config.Generic) (*generic, error) {
+	if len(cfg.GitPaths) == 0 {
+		return nil, errors.New("generic provider requires at least one git path")
+	}
+	g := &generic{cfg: cfg}
+	for _, tpl := range g.pathTemplates() {
+		if !strings.Contains(tpl, repositoryPlaceholder) {
+			return nil, fmt.Errorf("generic path %s does not contain %s", tpl, repositoryPlaceholder)
+		}
+	}
+	switch cfg.Auth.Type {
+	case config.GenericBasicAuthType, config.GenericBearerAuthType:
+	case config.GenericHeaderAuthType:
+		if cfg.Auth.Header == "" {
+			return nil, errors.New("generic header authentication requires a header name")
+		}
+	default:
+		return nil, fmt.Errorf("invalid generic authentication type %s", cfg.Auth.Type)
+	}
+	return g, nil
+}
+
+func (g *generic) pathTemplates() []string {
+	templates := []string{}
+	templates = append(templates, g.cfg.GitPaths...)
+	templates = append(templates, g.cfg.API.Paths...)
+	return templates
+}
+
+func (g *generic) getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error) {
+	regexes := []*regexp.Regexp{}
+	for _, tpl := range g.pathTemplates() {
+		r, err := compilePathTemplate(tpl, organization, project, repository)
+		if err != nil {
+			return nil, fmt.Errorf("invalid generic path %s: %w", tpl, err)
+		}
+		regexes = append(regexes, r)
+	}
+	return regexes, nil
+}
+
+func (g *generic) getGitPaths(organization, project, repository string) []string {
+	paths := []string{}
+	for _, tpl := range g.cfg.GitPaths {
+		paths = append(paths, expandPathTemplate(tpl, organization, project, repository))
+	}
+	return paths
+}
+
+// compilePathTemplate returns a regex which matches the path template and any sub paths, with the placeholders
+// replaced by the organization, project and repository.
+func compilePathTemplate(tpl, organization, project, repository string) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf(`(?i)^%s(/.*)?$`, expandPathTemplate(tpl, organization, project, repository)))
+}
+
+// expandPathTemplate returns the regex of the path template with the placeholders replaced.
+func expandPathTemplate(tpl, organization, project, repository string) string {
+	replacer := strings.NewReplacer(
+		regexp.QuoteMeta(organizationPlaceholder), pathSegment(organization),
+		regexp.QuoteMeta(projectPlaceholder), pathSegment(project),
+		regexp.QuoteMeta(repositoryPlaceholder), pathSegment(repository),
+	)
+	return replacer.Replace(regexp.QuoteMeta(tpl))
+}
+
+func (g *generic) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
+	switch g.cfg.Auth.Type {
+	case config.GenericBasicAuthType:
+		tokenB64 := b64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", g.cfg.Auth.Username, g.cfg.Auth.Password)))
+		return fmt.Sprintf("Basic %s", tokenB64), nil
+	case config.GenericBearerAuthType:
+		return fmt.Sprintf("Bearer %s", g.cfg.Auth.Token), nil
+	default:
+		// header authentication is set in authorizeRequest
+		return "", nil
+	}
+}
+
+func (g *generic) authorizeRequest(ctx context.Context, req *http.Request) error {
+	if g.cfg.Auth.Type != config.GenericHeaderAuthType {
+		return nil
+	}
+	req.Header.Set(g.cfg.Auth.Header, g.cfg.Auth.Token)
+	return nil
+}
+
+func (g *generic) isApi(path string) bool {
+	return g.cfg.API.Prefix != "" && strings.HasPrefix(path, g.cfg.API.Prefix)
+}
+
+func (g *generic) getHost(e *Endpoint, path string) string {
+	if g.cfg.API.Host != "" && g.isApi(path) {
+		return g.cfg.API.Host
+	}
+	return e.host
+}
+
+func (g *generic) getPath(e *Endpoint, path string) string {
+	if g.cfg.API.StripPrefix && g.isApi(path) {
+		return fmt.Sprintf("/%s", strings.TrimPrefix(strings.TrimPrefix(path, g.cfg.API.Prefix), "/"))
+	}
+	return path
+}
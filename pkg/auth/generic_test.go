@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func getGenericAuthorizer(auth config.GenericAuth) *Authorizer {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.GenericProviderType,
+				Generic: config.Generic{
+					GitPaths: []string{"/git/{organization}/{repository}.git"},
+					API: config.GenericAPI{
+						Paths:       []string{"/api/repos/{organization}/{repository}"},
+						Prefix:      "/api/",
+						Host:        "api.example.com",
+						StripPrefix: true,
+					},
+					Auth: auth,
+				},
+				Host:   "example.com",
+				Scheme: "https",
+				Name:   "org",
+				Repositories: []*config.Repository{
+					{
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return authz
+}
+
+func TestGenericAuthorization(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected bool
+	}{
+		{
+			name:     "allow repo",
+			path:     "/git/org/repo.git/info/refs",
+			expected: true,
+		},
+		{
+			name:     "allow api",
+			path:     "/api/repos/org/repo/commits",
+			expected: true,
+		},
+		{
+			name:     "disallow wrong repo",
+			path:     "/git/org/foo.git",
+			expected: false,
+		},
+		{
+			name:     "disallow repo without template prefix",
+			path:     "/org/repo.git",
+			expected: false,
+		},
+		{
+			name:     "disallow other api",
+			path:     "/api/repos/org",
+			expected: false,
+		},
+	}
+	authz := getGenericAuthorizer(config.GenericAuth{Type: config.GenericBearerAuthType, Token: "foo"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := authz.GetEndpointById("example.com-org-repo")
+			require.NoError(t, err)
+			err = authz.IsPermitted(tt.path, endpoint.Grants[0].Token)
+			if tt.expected {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestGenericUpdateRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		auth           config.GenericAuth
+		path           string
+		expectedHost   string
+		expectedPath   string
+		expectedHeader string
+		expectedValue  string
+	}{
+		{
+			name:           "basic git",
+			auth:           config.GenericAuth{Type: config.GenericBasicAuthType, Username: "foo", Password: "bar"},
+			path:           "/git/org/repo.git/info/refs",
+			expectedHost:   "example.com",
+			expectedPath:   "/git/org/repo.git/info/refs",
+			expectedHeader: "Authorization",
+			expectedValue:  "Basic Zm9vOmJhcg==",
+		},
+		{
+			name:           "bearer api",
+			auth:           config.GenericAuth{Type: config.GenericBearerAuthType, Token: "foo"},
+			path:           "/api/repos/org/repo",
+			expectedHost:   "api.example.com",
+			expectedPath:   "/repos/org/repo",
+			expectedHeader: "Authorization",
+			expectedValue:  "Bearer foo",
+		},
+		{
+			name:           "custom header",
+			auth:           config.GenericAuth{Type: config.GenericHeaderAuthType, Header: "Private-Token", Token: "foo"},
+			path:           "/git/org/repo.git",
+			expectedHost:   "example.com",
+			expectedPath:   "/git/org/repo.git",
+			expectedHeader: "Private-Token",
+			expectedValue:  "foo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authz := getGenericAuthorizer(tt.auth)
+			endpoint, err := authz.GetEndpointById("example.com-org-repo")
+			require.NoError(t, err)
+			req := &http.Request{Header: http.Header{}, URL: &url.URL{Path: tt.path}}
+			req.Header.Set("Authorization", "Bearer local")
+			req, u, err := authz.UpdateRequest(context.TODO(), req, endpoint.Grants[0].Token)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedHost, u.Host)
+			require.Equal(t, tt.expectedPath, req.URL.Path)
+			require.Equal(t, tt.expectedValue, req.Header.Get(tt.expectedHeader))
+			if tt.expectedHeader != "Authorization" {
+				require.Empty(t, req.Header.Get("Authorization"))
+			}
+		})
+	}
+}
+
+func TestGenericInvalidConfiguration(t *testing.T) {
+	_, err := newGeneric(&config.Generic{Auth: config.GenericAuth{Type: config.GenericBearerAuthType}})
+	require.Error(t, err)
+	_, err = newGeneric(&config.Generic{GitPaths: []string{"/{organization}"}, Auth: config.GenericAuth{Type: config.GenericBearerAuthType}})
+	require.Error(t, err)
+	_, err = newGeneric(&config.Generic{GitPaths: []string{"/{repository}"}, Auth: config.GenericAuth{Type: config.GenericHeaderAuthType}})
+	require.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	giteaApiPrefix = "/api/v1/"
+	giteaPageSize  = 50
+)
+
+// gitea implements the provider for both Gitea and Forgejo as they share the same paths and authentication.
+type gitea struct {
+	token string
+}
+
+func newGitea(token string) *gitea {
+	return &gitea{
+		token: token,
+	}
+}
+
+func (g *gitea) getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error) {
+	organization = pathSegment(organization)
+	repository = pathSegment(repository)
+	git, err := regexp.Compile(fmt.Sprintf(`(?i)^/%s/%s(\.git)?(/.*)?$`, organization, repository))
+	if err != nil {
+		return nil, err
+	}
+	api, err := regexp.Compile(fmt.Sprintf(`(?i)^/api/v1/repos/%s/%s(/.*)?$`, organization, repository))
+	if err != nil {
+		return nil, err
+	}
+	return []*regexp.Regexp{git, api}, nil
+}
+
+func (g *gitea) getGitPaths(organization, project, repository string) []string {
+	return []string{fmt.Sprintf("/%s/%s", pathSegment(organization), pathSegment(repository))}
+}
+
+func (g *gitea) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
+	if strings.HasPrefix(path, giteaApiPrefix) {
+		return fmt.Sprintf("token %s", g.token), nil
+	}
+	tokenB64 := b64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("x-access-token:%s", g.token)))
+	return fmt.Sprintf("Basic %s", tokenB64), nil
+}
+
+func (g *gitea) getHost(e *Endpoint, path string) string {
+	return e.host
+}
+
+func (g *gitea) getPath(e *Endpoint, path string) string {
+	return path
+}
+
+func (g *gitea) listRepositories(ctx context.Context, client *apiClient, organization, project string) ([]string, error) {
+	return listPages(giteaPageSize, func(page int) ([]string, error) {
+		repos := []struct {
+			Name string `json:"name"`
+		}{}
+		query := url.Values{"limit": []string{strconv.Itoa(giteaPageSize)}, "page": []string{strconv.Itoa(page)}}
+		err := client.get(ctx, fmt.Sprintf("/api/v1/orgs/%s/repos", url.PathEscape(organization)), query, &repos)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, r := range repos {
+			names = append(names, r.Name)
+		}
+		return names, nil
+	})
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func getGiteaAuthorizer() *Authorizer {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.GiteaProviderType,
+				Gitea: config.Gitea{
+					Token: "foo",
+				},
+				Host: "codeberg.org",
+				Name: "org",
+				Repositories: []*config.Repository{
+					{
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	auth, err := NewAuthorizer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return auth
+}
+
+func TestGiteaAuthorization(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected bool
+	}{
+		{
+			name:     "allow repo",
+			path:     "/org/repo.git/info/refs",
+			expected: true,
+		},
+		{
+			name:     "allow repo without suffix",
+			path:     "/Org/repo/info/refs",
+			expected: true,
+		},
+		{
+			name:     "allow api",
+			path:     "/api/v1/repos/org/repo/pulls",
+			expected: true,
+		},
+		{
+			name:     "disallow wrong org",
+			path:     "/foo/repo.git",
+			expected: false,
+		},
+		{
+			name:     "disallow wrong repo in api",
+			path:     "/api/v1/repos/org/foo",
+			expected: false,
+		},
+		{
+			name:     "disallow org api",
+			path:     "/api/v1/orgs/org/repos",
+			expected: false,
+		},
+	}
+	authz := getGiteaAuthorizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := authz.GetEndpointById("codeberg.org-org-repo")
+			require.NoError(t, err)
+			err = authz.IsPermitted(tt.path, endpoint.Grants[0].Token)
+			if tt.expected {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestGiteaGetAuthorization(t *testing.T) {
+	g := newGitea("foo")
+	authorization, err := g.getAuthorizationHeader(context.TODO(), "/api/v1/repos/org/repo")
+	require.NoError(t, err)
+	require.Equal(t, "token foo", authorization)
+	authorization, err = g.getAuthorizationHeader(context.TODO(), "/org/repo.git")
+	require.NoError(t, err)
+	require.Equal(t, "Basic eC1hY2Nlc3MtdG9rZW46Zm9v", authorization)
+}
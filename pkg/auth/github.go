@@ -1,52 +1,356 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
+	gh "github.com/google/go-github/v71/github"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
 )
 
-const standardGitHub = "github.com"
+const (
+	standardGitHub = "github.com"
+	githubPageSize = 100
+	// installationLookupTimeout limits how long discovering an installation can block a request.
+	installationLookupTimeout = 30 * time.Second
+	// failedLookupTTL is how long a failed installation lookup is cached before the API is queried again.
+	failedLookupTTL = 30 * time.Second
+)
 
 type GitHubTokenSource interface {
 	Token(ctx context.Context) (string, error)
 }
 
+// githubApps caches GitHub Apps by host and app ID so that organizations sharing an installation also share tokens.
+type githubApps map[string]*githubApp
+
+func (g githubApps) get(scheme, host string, appID int64, privateKey string) (*githubApp, error) {
+	key := fmt.Sprintf("%s-%d", host, appID)
+	if app, ok := g[key]; ok {
+		return app, nil
+	}
+	pemData, err := decodePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	atr, err := ghinstallation.NewAppsTransport(http.DefaultTransport, appID, pemData)
+	if err != nil {
+		return nil, err
+	}
+	atr.BaseURL = getGitHubApiBaseURL(scheme, host)
+	app := &githubApp{
+		atr:             atr,
+		client:          &http.Client{Transport: atr, Timeout: installationLookupTimeout},
+		now:             time.Now,
+		installations:   map[string]*ghinstallation.Transport{},
+		installationIDs: map[string]int64{},
+		failedLookups:   map[string]failedLookup{},
+	}
+	g[key] = app
+	return app, nil
+}
+
+// decodePrivateKey returns the PEM data of a private key which is either PEM encoded, as when read from a file, or
+// base64 encoded PEM.
+func decodePrivateKey(privateKey string) ([]byte, error) {
+	if strings.HasPrefix(privateKey, "-----BEGIN") {
+		return []byte(privateKey), nil
+	}
+	return b64.URLEncoding.DecodeString(privateKey)
+}
+
+// getGitHubApiBaseURL returns the API URL used by the GitHub App, which differs between GitHub and GitHub Enterprise.
+func getGitHubApiBaseURL(scheme, host string) string {
+	if host == standardGitHub {
+		return fmt.Sprintf("%s://api.%s", scheme, host)
+	}
+	return fmt.Sprintf("%s://%s/api/v3", scheme, host)
+}
+
+// githubApp keeps one installation transport per installation of the app and token options.
+type githubApp struct {
+	atr    *ghinstallation.AppsTransport
+	client *http.Client
+	now    func() time.Time
+	// lookups makes sure that concurrent requests for the same account share a single installation lookup.
+	lookups singleflight.Group
+
+	mu              sync.Mutex
+	installations   map[string]*ghinstallation.Transport
+	installationIDs map[string]int64
+	failedLookups   map[string]failedLookup
+}
+
+// failedLookup is the error of an installation lookup, which is returned until it expires.
+type failedLookup struct {
+	err     error
+	expires time.Time
+}
+
+func (a *githubApp) getInstallation(installationID int64, options *gh.InstallationTokenOptions) (*ghinstallation.Transport, error) {
+	key := fmt.Sprintf("%d", installationID)
+	if options != nil {
+		b, err := json.Marshal(options)
+		if err != nil {
+			return nil, err
+		}
+		key = fmt.Sprintf("%s-%s", key, b)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if itr, ok := a.installations[key]; ok {
+		return itr, nil
+	}
+	itr := ghinstallation.NewFromAppsTransport(a.atr, installationID)
+	itr.InstallationTokenOptions = options
+	a.installations[key] = itr
+	return itr, nil
+}
+
+// getInstallationID returns the cached installation ID of an account, discovering it if it is not known. The lookup is done
+// without holding the lock so that it does not block token requests for other installations.
+func (a *githubApp) getInstallationID(ctx context.Context, account string) (int64, error) {
+	a.mu.Lock()
+	if installationID, ok := a.installationIDs[account]; ok {
+		a.mu.Unlock()
+		return installationID, nil
+	}
+	if failed, ok := a.failedLookups[account]; ok && a.now().Before(failed.expires) {
+		a.mu.Unlock()
+		return 0, failed.err
+	}
+	a.mu.Unlock()
+
+	v, err, _ := a.lookups.Do(account, func() (interface{}, error) {
+		installationID, err := a.findInstallationID(ctx, account)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err != nil {
+			// Lookups which are canceled by the request are not the fault of the installation
+			if ctx.Err() == nil {
+				a.failedLookups[account] = failedLookup{err: err, expires: a.now().Add(failedLookupTTL)}
+			}
+			return int64(0), err
+		}
+		delete(a.failedLookups, account)
+		a.installationIDs[account] = installationID
+		return installationID, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+// findInstallationID looks up the installation of the app in an organization, falling back to a user account.
+func (a *githubApp) findInstallationID(ctx context.Context, account string) (int64, error) {
+	for _, kind := range []string{"orgs", "users"} {
+		reqURL := fmt.Sprintf("%s/%s/%s/installation", strings.TrimRight(a.atr.BaseURL, "/"), kind, url.PathEscape(account))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return 0, fmt.Errorf("could not get installation for %s: %w", account, err)
+		}
+		installation := struct {
+			ID int64 `json:"id"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&installation)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("received status %s when getting installation for %s", resp.Status, account)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("could not decode installation for %s: %w", account, err)
+		}
+		return installation.ID, nil
+	}
+	return 0, fmt.Errorf("app is not installed for %s", account)
+}
+
+// installationTokenSource returns tokens for the installation of an account. The installation is discovered on first use when
+// the installation ID is not known. Tokens are restricted to the repositories and permissions in the options when set.
+type installationTokenSource struct {
+	app            *githubApp
+	account        string
+	installationID int64
+	options        *gh.InstallationTokenOptions
+}
+
+func (i *installationTokenSource) Token(ctx context.Context) (string, error) {
+	installationID := i.installationID
+	if installationID == 0 {
+		var err error
+		installationID, err = i.app.getInstallationID(ctx, i.account)
+		if err != nil {
+			return "", err
+		}
+	}
+	itr, err := i.app.getInstallation(installationID, i.options)
+	if err != nil {
+		return "", err
+	}
+	return itr.Token(ctx)
+}
+
+// staticTokenSource returns the same personal access token for every request.
+type staticTokenSource struct {
+	token string
+}
+
+func (s *staticTokenSource) Token(ctx context.Context) (string, error) {
+	return s.token, nil
+}
+
 type github struct {
 	itr GitHubTokenSource
+	// username is set when authenticating as a machine user with basic authentication.
+	username string
+	// scopedTokenSource returns a token source restricted to a single repository, it is nil when all
+	// repositories share the installation token.
+	scopedTokenSource func(repository string) GitHubTokenSource
 }
 
-func newGithub(appID, installationID int64, privateKey []byte) (*github, error) {
-	itr, err := ghinstallation.New(http.DefaultTransport, appID, installationID, privateKey)
+func newGithub(app *githubApp, organization string, cfg config.GitHub) (*github, error) {
+	g := &github{
+		itr: &installationTokenSource{
+			app:            app,
+			account:        organization,
+			installationID: cfg.InstallationID,
+		},
+	}
+	if !cfg.RepositoryScoped {
+		return g, nil
+	}
+	permissions, err := getInstallationPermissions(cfg.Permissions)
 	if err != nil {
 		return nil, err
 	}
-	return &github{itr: itr}, nil
+	g.scopedTokenSource = func(repository string) GitHubTokenSource {
+		return &installationTokenSource{
+			app:            app,
+			account:        organization,
+			installationID: cfg.InstallationID,
+			options: &gh.InstallationTokenOptions{
+				Repositories: []string{repository},
+				Permissions:  permissions,
+			},
+		}
+	}
+	return g, nil
+}
+
+func newGithubPat(cfg config.GitHub) (*github, error) {
+	if cfg.AppID != 0 || cfg.PrivateKey != "" {
+		return nil, errors.New("personal access token cannot be combined with a GitHub App")
+	}
+	if cfg.RepositoryScoped {
+		return nil, errors.New("repository scoped tokens require a GitHub App")
+	}
+	return &github{
+		itr:      &staticTokenSource{token: cfg.Pat},
+		username: cfg.Username,
+	}, nil
+}
+
+// getInstallationPermissions converts permissions in the format {"contents": "read"} to installation permissions.
+func getInstallationPermissions(permissions map[string]string) (*gh.InstallationPermissions, error) {
+	if len(permissions) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(permissions)
+	if err != nil {
+		return nil, err
+	}
+	installationPermissions := &gh.InstallationPermissions{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(installationPermissions); err != nil {
+		return nil, fmt.Errorf("invalid GitHub permissions: %w", err)
+	}
+	return installationPermissions, nil
+}
+
+func (g *github) forRepository(repository string) Provider {
+	if g.scopedTokenSource == nil {
+		return g
+	}
+	return &github{itr: g.scopedTokenSource(repository)}
 }
 
 func (g *github) getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error) {
-	git, err := regexp.Compile(fmt.Sprintf(`(?i)/%s/%s(/.*)?\b`, organization, repository))
+	organization = pathSegment(organization)
+	repository = pathSegment(repository)
+	git, err := regexp.Compile(fmt.Sprintf(`(?i)^/%s/%s(\.git)?(/.*)?$`, organization, repository))
 	if err != nil {
 		return nil, err
 	}
-	api, err := regexp.Compile(fmt.Sprintf(`(?i)/api/v3/(.*)/%s/%s/(/.*)?\b`, organization, repository))
+	api, err := regexp.Compile(fmt.Sprintf(`(?i)^/api/v3/repos/%s/%s(/.*)?$`, organization, repository))
 	if err != nil {
 		return nil, err
 	}
 	return []*regexp.Regexp{git, api}, nil
 }
 
+func (g *github) getGitPaths(organization, project, repository string) []string {
+	return []string{fmt.Sprintf("/%s/%s", pathSegment(organization), pathSegment(repository))}
+}
+
+// getDefaultRules limits API requests to reading the repository and to its pull requests, commits and commit statuses,
+// so that the repository, its settings, hooks and collaborators cannot be modified.
+func (g *github) getDefaultRules() []config.PolicyRule {
+	return []config.PolicyRule{
+		{
+			Name: "repository-pull-requests",
+			Path: "/api/v3/repos/{organization}/{repository}/pulls",
+		},
+		{
+			Name: "repository-commits",
+			Path: "/api/v3/repos/{organization}/{repository}/commits",
+		},
+		{
+			Name:    "repository-statuses",
+			Methods: []string{http.MethodGet, http.MethodPost},
+			Path:    "/api/v3/repos/{organization}/{repository}/statuses",
+		},
+		{
+			Name:    "repository-read",
+			Methods: []string{http.MethodGet},
+			Path:    "/api/v3/repos/{organization}/{repository}",
+		},
+	}
+}
+
 func (g *github) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
 	token, err := g.itr.Token(ctx)
 	if err != nil {
 		return "", fmt.Errorf("error when fetching GitHub JWT token: %w", err)
 	}
 
+	if g.username != "" {
+		tokenB64 := b64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", g.username, token)))
+		return fmt.Sprintf("Basic %s", tokenB64), nil
+	}
 	if strings.HasPrefix(path, "/api/v3/") {
 		return fmt.Sprintf("Bearer %s", token), nil
 	}
@@ -71,3 +375,21 @@ func (g *github) getPath(e *Endpoint, path string) string {
 	newPath := strings.TrimPrefix(path, "/api/v3")
 	return newPath
 }
+
+func (g *github) listRepositories(ctx context.Context, client *apiClient, organization, project string) ([]string, error) {
+	return listPages(githubPageSize, func(page int) ([]string, error) {
+		repos := []struct {
+			Name string `json:"name"`
+		}{}
+		query := url.Values{"per_page": []string{strconv.Itoa(githubPageSize)}, "page": []string{strconv.Itoa(page)}}
+		err := client.get(ctx, fmt.Sprintf("/api/v3/orgs/%s/repos", url.PathEscape(organization)), query, &repos)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, r := range repos {
+			names = append(names, r.Name)
+		}
+		return names, nil
+	})
+}
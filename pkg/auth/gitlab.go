@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	gitLabApiPrefix = "/api/v4/"
+	gitLabPageSize  = 100
+)
+
+type gitlab struct {
+	token string
+}
+
+func newGitlab(token string) *gitlab {
+	return &gitlab{
+		token: token,
+	}
+}
+
+// getPathRegex expects the organization to be the top level group and the project to be the optional
+// subgroup path, which may contain multiple groups separated with slashes.
+func (g *gitlab) getPathRegex(organization, project, repository string) ([]*regexp.Regexp, error) {
+	comps := []string{organization}
+	if project != "" {
+		comps = append(comps, project)
+	}
+	comps = append(comps, repository)
+	apiComps := []string{}
+	for _, comp := range comps {
+		// The API identifies projects by their full path with URL encoded slashes
+		if comp == anyPathSegment {
+			apiComps = append(apiComps, `[^/%]+`)
+			continue
+		}
+		apiComps = append(apiComps, regexp.QuoteMeta(strings.ReplaceAll(comp, "/", "%2F")))
+	}
+
+	git, err := regexp.Compile(fmt.Sprintf(`(?i)^%s(\.git)?(/.*)?$`, g.getGitPaths(organization, project, repository)[0]))
+	if err != nil {
+		return nil, err
+	}
+	api, err := regexp.Compile(fmt.Sprintf(`(?i)^/api/v4/projects/%s(/.*)?$`, strings.Join(apiComps, "%2F")))
+	if err != nil {
+		return nil, err
+	}
+	return []*regexp.Regexp{git, api}, nil
+}
+
+func (g *gitlab) getGitPaths(organization, project, repository string) []string {
+	comps := []string{organization}
+	if project != "" {
+		comps = append(comps, project)
+	}
+	comps = append(comps, repository)
+	gitComps := []string{}
+	for _, comp := range comps {
+		gitComps = append(gitComps, pathSegment(comp))
+	}
+	return []string{"/" + strings.Join(gitComps, "/")}
+}
+
+func (g *gitlab) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
+	if strings.HasPrefix(path, gitLabApiPrefix) {
+		return fmt.Sprintf("Bearer %s", g.token), nil
+	}
+	tokenB64 := b64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("oauth2:%s", g.token)))
+	return fmt.Sprintf("Basic %s", tokenB64), nil
+}
+
+func (g *gitlab) getHost(e *Endpoint, path string) string {
+	return e.host
+}
+
+func (g *gitlab) getPath(e *Endpoint, path string) string {
+	return path
+}
+
+// listRepositories lists the projects of the group, which is the subgroup path when a project is set.
+func (g *gitlab) listRepositories(ctx context.Context, client *apiClient, organization, project string) ([]string, error) {
+	group := organization
+	if project != "" {
+		group = fmt.Sprintf("%s/%s", organization, project)
+	}
+	apiPath := fmt.Sprintf("/api/v4/groups/%s/projects", strings.ReplaceAll(group, "/", "%2F"))
+	return listPages(gitLabPageSize, func(page int) ([]string, error) {
+		projects := []struct {
+			Path string `json:"path"`
+		}{}
+		query := url.Values{"per_page": []string{strconv.Itoa(gitLabPageSize)}, "page": []string{strconv.Itoa(page)}}
+		if err := client.get(ctx, apiPath, query, &projects); err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, p := range projects {
+			names = append(names, p.Path)
+		}
+		return names, nil
+	})
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func getGitLabAuthorizer() *Authorizer {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.GitLabProviderType,
+				GitLab: config.GitLab{
+					Token: "foo",
+				},
+				Host: "gitlab.com",
+				Name: "org",
+				Repositories: []*config.Repository{
+					{
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+					{
+						Project:    "sub/group",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	auth, err := NewAuthorizer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return auth
+}
+
+func TestGitLabAuthorization(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		path     string
+		expected bool
+	}{
+		{
+			name:     "allow repo",
+			id:       "gitlab.com-org-repo",
+			path:     "/org/repo.git/info/refs",
+			expected: true,
+		},
+		{
+			name:     "allow repo without suffix",
+			id:       "gitlab.com-org-repo",
+			path:     "/Org/Repo",
+			expected: true,
+		},
+		{
+			name:     "allow subgroup repo",
+			id:       "gitlab.com-org-sub/group-repo",
+			path:     "/org/sub/group/repo.git/git-upload-pack",
+			expected: true,
+		},
+		{
+			name:     "allow api",
+			id:       "gitlab.com-org-repo",
+			path:     "/api/v4/projects/org%2Frepo/merge_requests",
+			expected: true,
+		},
+		{
+			name:     "allow subgroup api",
+			id:       "gitlab.com-org-sub/group-repo",
+			path:     "/api/v4/projects/org%2Fsub%2Fgroup%2Frepo",
+			expected: true,
+		},
+		{
+			name:     "disallow repo in subgroup",
+			id:       "gitlab.com-org-repo",
+			path:     "/org/sub/group/repo.git",
+			expected: false,
+		},
+		{
+			name:     "disallow repo with prefix",
+			id:       "gitlab.com-org-repo",
+			path:     "/org/repo-foo.git",
+			expected: false,
+		},
+		{
+			name:     "disallow wrong org",
+			id:       "gitlab.com-org-repo",
+			path:     "/foo/org/repo.git",
+			expected: false,
+		},
+		{
+			name:     "disallow wrong repo in api",
+			id:       "gitlab.com-org-repo",
+			path:     "/api/v4/projects/org%2Ffoo",
+			expected: false,
+		},
+		{
+			name:     "disallow other api",
+			id:       "gitlab.com-org-repo",
+			path:     "/api/v4/projects",
+			expected: false,
+		},
+	}
+	authz := getGitLabAuthorizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := authz.GetEndpointById(tt.id)
+			require.NoError(t, err)
+			err = authz.IsPermitted(tt.path, endpoint.Grants[0].Token)
+			if tt.expected {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestGitLabGetAuthorization(t *testing.T) {
+	gl := newGitlab("foo")
+	authorization, err := gl.getAuthorizationHeader(context.TODO(), "/api/v4/projects/org%2Frepo")
+	require.NoError(t, err)
+	require.Equal(t, "Bearer foo", authorization)
+	authorization, err = gl.getAuthorizationHeader(context.TODO(), "/org/repo.git/info/refs")
+	require.NoError(t, err)
+	require.Equal(t, "Basic b2F1dGgyOmZvbw==", authorization)
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"maps"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+// UpdateNamespaces sets the labels of all namespaces in the cluster. Grants are added for namespaces which match the
+// namespace selector of an endpoint and revoked for namespaces which no longer match.
+func (a *Authorizer) UpdateNamespaces(namespaces map[string]map[string]string) error {
+	a.mu.Lock()
+	a.namespaceLabels = namespaces
+	changed, err := a.applyNamespaceSelectors()
+	a.mu.Unlock()
+
+	if changed {
+		a.notify()
+	}
+	return err
+}
+
+// HasNamespaceSelectors returns true if any endpoint selects namespaces by their labels.
+func (a *Authorizer) HasNamespaceSelectors() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, e := range a.endpoints {
+		if e.namespaceSelector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// applyNamespaceSelectors updates the grants of all endpoints with a namespace selector, the caller has to hold the lock.
+func (a *Authorizer) applyNamespaceSelectors() (bool, error) {
+	changed := false
+	for _, e := range slices.Clone(a.endpoints) {
+		grants, ok, err := a.selectNamespaces(e)
+		if err != nil {
+			return changed, err
+		}
+		if !ok {
+			continue
+		}
+		// Endpoints are replaced instead of modified as they are read without holding the lock
+		next := e.withGrants(grants)
+		a.replaceEndpoint(e, next, func(g *Grant) bool {
+			_, err := next.GetGrant(g.Namespace)
+			return err != nil
+		})
+		changed = true
+	}
+	return changed, nil
+}
+
+// selectNamespaces returns the configured grants of the endpoint together with grants for the namespaces which match its
+// namespace selector, and if the selected namespaces have changed. Grants of namespaces which are still selected are
+// kept so that their tokens do not change. The caller has to hold the lock.
+func (a *Authorizer) selectNamespaces(e *Endpoint) ([]*Grant, bool, error) {
+	if e.namespaceSelector == nil {
+		return e.Grants, false, nil
+	}
+	grants := []*Grant{}
+	configured := map[string]bool{}
+	selected := map[string]*Grant{}
+	for _, g := range e.Grants {
+		if g.selected {
+			selected[g.Namespace] = g
+			continue
+		}
+		configured[g.Namespace] = true
+		grants = append(grants, g)
+	}
+
+	changed := false
+	kept := 0
+	for _, name := range slices.Sorted(maps.Keys(a.namespaceLabels)) {
+		// Configured namespaces override the settings of the repository
+		if configured[name] || !e.namespaceSelector.Matches(labels.Set(a.namespaceLabels[name])) {
+			continue
+		}
+		if g, ok := selected[name]; ok {
+			grants = append(grants, g)
+			kept++
+			continue
+		}
+		g, err := newGrant(e, &config.Namespace{Name: name})
+		if err != nil {
+			return nil, false, err
+		}
+		g.selected = true
+		a.restoreToken(g)
+		grants = append(grants, g)
+		changed = true
+	}
+	if kept != len(selected) {
+		changed = true
+	}
+	return grants, changed, nil
+}
+
+// withGrants returns a copy of the endpoint with the given grants.
+func (e *Endpoint) withGrants(grants []*Grant) *Endpoint {
+	next := *e
+	next.Grants = make([]*Grant, 0, len(grants))
+	for _, g := range grants {
+		grant := *g
+		grant.endpoint = &next
+		next.Grants = append(next.Grants, &grant)
+	}
+	return &next
+}
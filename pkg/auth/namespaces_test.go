@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestNamespaceSelector(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Project:           "proj",
+						Name:              "repo",
+						Access:            config.ReadAccessLevel,
+						Namespaces:        []*config.Namespace{{Name: "configured", Access: config.WriteAccessLevel}},
+						NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "true"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	require.True(t, authz.HasNamespaceSelectors())
+	path := "/org/proj/_git/repo"
+	e, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.Len(t, e.Grants, 1)
+
+	err = authz.UpdateNamespaces(map[string]map[string]string{
+		"configured": {"tenant": "true"},
+		"team-a":     {"tenant": "true"},
+		"team-b":     {"tenant": "true"},
+		"other":      {},
+	})
+	require.NoError(t, err)
+	<-authz.Updated()
+	e, err = authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.Len(t, e.Grants, 3)
+	// Configured namespaces keep their own settings
+	configured, err := e.GetGrant("configured")
+	require.NoError(t, err)
+	require.Equal(t, config.AccessLevel(config.WriteAccessLevel), configured.access)
+	teamA, err := e.GetGrant("team-a")
+	require.NoError(t, err)
+	require.Equal(t, config.AccessLevel(config.ReadAccessLevel), teamA.access)
+	require.NoError(t, authz.IsPermitted(path, teamA.Token))
+	teamB, err := e.GetGrant("team-b")
+	require.NoError(t, err)
+	_, err = e.GetGrant("other")
+	require.Error(t, err)
+
+	// Unchanged namespaces keep their tokens and nothing is updated
+	err = authz.UpdateNamespaces(map[string]map[string]string{
+		"configured": {"tenant": "true"},
+		"team-a":     {"tenant": "true"},
+		"team-b":     {"tenant": "true"},
+	})
+	require.NoError(t, err)
+	require.Empty(t, authz.Updated())
+
+	// Namespaces which no longer match lose their grants
+	err = authz.UpdateNamespaces(map[string]map[string]string{
+		"configured": {},
+		"team-a":     {"tenant": "true"},
+		"team-b":     {},
+	})
+	require.NoError(t, err)
+	<-authz.Updated()
+	e, err = authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.Len(t, e.Grants, 2)
+	g, err := e.GetGrant("team-a")
+	require.NoError(t, err)
+	require.Equal(t, teamA.Token, g.Token)
+	require.NoError(t, authz.IsPermitted(path, configured.Token))
+	require.Error(t, authz.IsPermitted(path, teamB.Token))
+
+	// Selected namespaces are kept when the configuration is reloaded
+	err = authz.Reload(context.TODO(), cfg)
+	require.NoError(t, err)
+	e, err = authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	g, err = e.GetGrant("team-a")
+	require.NoError(t, err)
+	require.Equal(t, teamA.Token, g.Token)
+}
+
+func TestHasNamespaceSelectors(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	require.False(t, authz.HasNamespaceSelectors())
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+// policyProvider is implemented by providers which have API paths that are broader than the repository, and
+// therefore limit API requests with default rules.
+type policyProvider interface {
+	getDefaultRules() []config.PolicyRule
+}
+
+type policyRule struct {
+	name   string
+	action config.PolicyAction
+	route  *route
+	// provided is true for the default rules of the provider, which are not configured explicitly.
+	provided bool
+}
+
+// policy evaluates API requests against an ordered list of rules, where the first matching rule decides if the
+// request is permitted. Requests which do not match any rule are denied, unless the policy does not contain any rules.
+type policy struct {
+	rules []*policyRule
+}
+
+// newPolicy returns the policy of a repository, the rules of the repository are evaluated before the rules of the
+// organization which are evaluated before the default rules of the provider.
+func newPolicy(provider Provider, o *config.Organization, r *config.Repository) (*policy, error) {
+	cfgRules := []config.PolicyRule{}
+	cfgRules = append(cfgRules, r.Policy.Rules...)
+	cfgRules = append(cfgRules, o.Policy.Rules...)
+	configured := len(cfgRules)
+	if pp, ok := provider.(policyProvider); ok && !r.Policy.DisableDefaults && !o.Policy.DisableDefaults {
+		cfgRules = append(cfgRules, pp.getDefaultRules()...)
+	}
+
+	p := &policy{}
+	for i, cfgRule := range cfgRules {
+		rt, err := newRoute(cfgRule.Methods, cfgRule.Path, o.Name, r.Project, r.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %s: %w", cfgRule.Name, err)
+		}
+		action := cfgRule.Action
+		if action == "" {
+			action = config.AllowPolicyAction
+		}
+		p.rules = append(p.rules, &policyRule{
+			name:     cfgRule.Name,
+			action:   action,
+			route:    rt,
+			provided: i >= configured,
+		})
+	}
+	return p, nil
+}
+
+func (p *policy) evaluate(req *http.Request) error {
+	if p == nil || len(p.rules) == 0 {
+		return nil
+	}
+	for _, rule := range p.rules {
+		if !rule.route.matches(req) {
+			continue
+		}
+		if rule.action == config.DenyPolicyAction {
+			return fmt.Errorf("%s %s denied by policy rule %s", req.Method, req.URL.EscapedPath(), rule.name)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s %s denied as it does not match any policy rule", req.Method, req.URL.EscapedPath())
+}
+
+// allowsExplicitly returns true if the first rule matching the request is a configured rule which permits it.
+func (p *policy) allowsExplicitly(req *http.Request) bool {
+	if p == nil {
+		return false
+	}
+	for _, rule := range p.rules {
+		if !rule.route.matches(req) {
+			continue
+		}
+		return rule.action == config.AllowPolicyAction && !rule.provided
+	}
+	return false
+}
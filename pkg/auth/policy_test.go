@@ -0,0 +1,320 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestPolicy(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Policy: config.Policy{
+					Rules: []config.PolicyRule{
+						{
+							Name:    "deny-commit-statuses",
+							Action:  config.DenyPolicyAction,
+							Methods: []string{http.MethodPost},
+							Path:    "/{organization}/{project}/_apis/git/repositories/{repository}/commits",
+						},
+					},
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "default",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+					{
+						Project:    "proj",
+						Name:       "override",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+						Policy: config.Policy{
+							Rules: []config.PolicyRule{
+								{
+									Name:    "allow-commit-statuses",
+									Methods: []string{http.MethodPost},
+									Path:    "/{organization}/{project}/_apis/git/repositories/{repository}/commits",
+								},
+							},
+						},
+					},
+					{
+						Project:    "proj",
+						Name:       "nodefaults",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+						Policy: config.Policy{
+							DisableDefaults: true,
+							Rules: []config.PolicyRule{
+								{
+									Name:    "allow-items",
+									Methods: []string{http.MethodGet},
+									Path:    "/{organization}/{project}/_apis/git/repositories/{repository}/items",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		id     string
+		method string
+		path   string
+		rule   string
+		allow  bool
+	}{
+		{
+			name:   "git is not affected",
+			id:     "foo-org-proj-default",
+			method: http.MethodPost,
+			path:   "/org/proj/_git/default/git-upload-pack",
+			allow:  true,
+		},
+		{
+			name:   "git with different case is not affected",
+			id:     "foo-org-proj-default",
+			method: http.MethodPost,
+			path:   "/org/proj/_git/default/Git-Receive-Pack",
+			allow:  true,
+		},
+		{
+			name:   "git lfs is not affected",
+			id:     "foo-org-proj-default",
+			method: http.MethodPost,
+			path:   "/org/proj/_git/default/info/lfs/objects/batch",
+			allow:  true,
+		},
+		{
+			name:   "api ending with ref advertisement path",
+			id:     "foo-org-proj-default",
+			method: http.MethodDelete,
+			path:   "/org/proj/_apis/git/repositories/default/refs/info/refs",
+			rule:   "does not match any policy rule",
+			allow:  false,
+		},
+		{
+			name:   "api ending with receive pack path",
+			id:     "foo-org-proj-default",
+			method: http.MethodPost,
+			path:   "/org/proj/_apis/git/repositories/default/pushes/git-receive-pack",
+			rule:   "does not match any policy rule",
+			allow:  false,
+		},
+		{
+			name:   "api containing lfs path",
+			id:     "foo-org-proj-default",
+			method: http.MethodPut,
+			path:   "/org/proj/_apis/git/repositories/default/info/lfs/objects",
+			rule:   "does not match any policy rule",
+			allow:  false,
+		},
+		{
+			name:   "default pull requests",
+			id:     "foo-org-proj-default",
+			method: http.MethodPost,
+			path:   "/org/proj/_apis/git/repositories/default/pullrequests",
+			allow:  true,
+		},
+		{
+			name:   "default resource areas",
+			id:     "foo-org-proj-default",
+			method: http.MethodGet,
+			path:   "/org/_apis/ResourceAreas/foo",
+			allow:  true,
+		},
+		{
+			name:   "organization api is denied",
+			id:     "foo-org-proj-default",
+			method: http.MethodGet,
+			path:   "/org/_apis/projects",
+			rule:   "does not match any policy rule",
+			allow:  false,
+		},
+		{
+			name:   "write outside of defaults is denied",
+			id:     "foo-org-proj-default",
+			method: http.MethodDelete,
+			path:   "/org/proj/_apis/git/repositories/default/refs",
+			rule:   "does not match any policy rule",
+			allow:  false,
+		},
+		{
+			name:   "organization rule denies before defaults",
+			id:     "foo-org-proj-default",
+			method: http.MethodPost,
+			path:   "/org/proj/_apis/git/repositories/default/commits/abc/statuses",
+			rule:   "deny-commit-statuses",
+			allow:  false,
+		},
+		{
+			name:   "organization rule only matches method",
+			id:     "foo-org-proj-default",
+			method: http.MethodGet,
+			path:   "/org/proj/_apis/git/repositories/default/commits/abc/statuses",
+			allow:  true,
+		},
+		{
+			name:   "repository rule is evaluated before organization rule",
+			id:     "foo-org-proj-override",
+			method: http.MethodPost,
+			path:   "/org/proj/_apis/git/repositories/override/commits/abc/statuses",
+			allow:  true,
+		},
+		{
+			name:   "disabled defaults",
+			id:     "foo-org-proj-nodefaults",
+			method: http.MethodPost,
+			path:   "/org/proj/_apis/git/repositories/nodefaults/pullrequests",
+			rule:   "does not match any policy rule",
+			allow:  false,
+		},
+		{
+			name:   "disabled defaults with rule",
+			id:     "foo-org-proj-nodefaults",
+			method: http.MethodGet,
+			path:   "/org/proj/_apis/git/repositories/nodefaults/items",
+			allow:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := authz.GetEndpointById(tt.id)
+			require.NoError(t, err)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			err = authz.IsRequestPermitted(req, endpoint.Grants[0].Token)
+			if tt.allow {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.rule)
+		})
+	}
+}
+
+func TestPolicyPathPrefix(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "collection",
+				AzureDevOps: config.AzureDevOps{
+					PathPrefix: "tfs",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	endpoint, err := authz.GetEndpointById("foo-collection-proj-repo")
+	require.NoError(t, err)
+
+	for _, path := range []string{"/collection/proj/_apis/git/repositories/repo/pullrequests", "/tfs/collection/proj/_apis/git/repositories/repo/pullrequests"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		require.NoError(t, authz.IsRequestPermitted(req, endpoint.Grants[0].Token))
+	}
+	for _, path := range []string{"/collection/proj/_git/repo/info/refs", "/tfs/collection/proj/_git/repo/info/refs"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		require.True(t, endpoint.isGitRequest(req))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/tfs/collection/_apis/projects", nil)
+	require.Error(t, authz.IsRequestPermitted(req, endpoint.Grants[0].Token))
+}
+
+func getGitHubPolicyToken(t *testing.T) (*Authorizer, string) {
+	t.Helper()
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.GitHubProviderType,
+				Host:     "github.com",
+				Name:     "org",
+				GitHub: config.GitHub{
+					Pat: "pat",
+				},
+				Repositories: []*config.Repository{
+					{
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	endpoint, err := authz.GetEndpointById("github.com-org-repo")
+	require.NoError(t, err)
+	return authz, endpoint.Grants[0].Token
+}
+
+func TestPolicyGitHubDefaults(t *testing.T) {
+	authz, token := getGitHubPolicyToken(t)
+	tests := []struct {
+		method string
+		path   string
+		allow  bool
+	}{
+		{method: http.MethodGet, path: "/api/v3/repos/org/repo", allow: true},
+		{method: http.MethodGet, path: "/api/v3/repos/org/repo/contents/README.md", allow: true},
+		{method: http.MethodPost, path: "/api/v3/repos/org/repo/pulls", allow: true},
+		{method: http.MethodPatch, path: "/api/v3/repos/org/repo/pulls/1", allow: true},
+		{method: http.MethodGet, path: "/api/v3/repos/org/repo/commits/abc", allow: true},
+		{method: http.MethodPost, path: "/api/v3/repos/org/repo/statuses/abc", allow: true},
+		{method: http.MethodDelete, path: "/api/v3/repos/org/repo", allow: false},
+		{method: http.MethodPatch, path: "/api/v3/repos/org/repo", allow: false},
+		{method: http.MethodPost, path: "/api/v3/repos/org/repo/hooks", allow: false},
+		{method: http.MethodPut, path: "/api/v3/repos/org/repo/collaborators/user", allow: false},
+		{method: http.MethodPut, path: "/api/v3/repos/org/repo/contents/README.md", allow: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			err := authz.IsRequestPermitted(req, token)
+			if tt.allow {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestPolicyGitHubGitSuffix(t *testing.T) {
+	authz, token := getGitHubPolicyToken(t)
+	for _, path := range []string{"/org/repo/info/refs", "/org/repo.git/git-receive-pack", "/org/repo.git/info/lfs/objects/batch"} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		require.NoError(t, authz.IsRequestPermitted(req, token), path)
+	}
+	// API requests to other repositories which end with a git path must not skip the policy
+	for _, path := range []string{
+		"/api/v3/repos/org/other/contents/org/repo/info/refs",
+		"/api/v3/repos/org/other/contents/org/repo/git-receive-pack",
+		"/api/v3/repos/org/other/contents/org/repo/info/lfs/objects",
+	} {
+		req := httptest.NewRequest(http.MethodPut, path, nil)
+		require.Error(t, authz.IsRequestPermitted(req, token), path)
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// refPattern matches ref names, where * matches any characters including slashes.
+type refPattern struct {
+	raw   string
+	regex *regexp.Regexp
+}
+
+func parseRefPatterns(patterns []string) ([]*refPattern, error) {
+	refs := []*refPattern{}
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "refs/") {
+			return nil, fmt.Errorf("ref pattern %s has to start with refs/", pattern)
+		}
+		expr := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `.*`)
+		regex, err := regexp.Compile(fmt.Sprintf("^%s$", expr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ref pattern %s: %w", pattern, err)
+		}
+		refs = append(refs, &refPattern{raw: pattern, regex: regex})
+	}
+	return refs, nil
+}
+
+// RestrictsRefs returns true if pushes are limited to specific refs.
+func (g *Grant) RestrictsRefs() bool {
+	return len(g.refs) > 0
+}
+
+// IsRefPermitted checks that the ref matches one of the allowed ref patterns.
+func (g *Grant) IsRefPermitted(ref string) error {
+	if !g.RestrictsRefs() {
+		return nil
+	}
+	for _, r := range g.refs {
+		if r.regex.MatchString(ref) {
+			return nil
+		}
+	}
+	patterns := []string{}
+	for _, r := range g.refs {
+		patterns = append(patterns, r.raw)
+	}
+	return fmt.Errorf("ref %s does not match allowed refs %s", ref, strings.Join(patterns, ", "))
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestRefPatterns(t *testing.T) {
+	refs, err := parseRefPatterns([]string{"refs/heads/flux-image-updates/*", "refs/heads/main"})
+	require.NoError(t, err)
+	g := &Grant{refs: refs}
+	require.True(t, g.RestrictsRefs())
+	require.NoError(t, g.IsRefPermitted("refs/heads/flux-image-updates/app"))
+	require.NoError(t, g.IsRefPermitted("refs/heads/flux-image-updates/team/app"))
+	require.NoError(t, g.IsRefPermitted("refs/heads/main"))
+	require.Error(t, g.IsRefPermitted("refs/heads/main-old"))
+	require.Error(t, g.IsRefPermitted("refs/tags/v1.0.0"))
+
+	_, err = parseRefPatterns([]string{"heads/main"})
+	require.Error(t, err)
+
+	g = &Grant{}
+	require.False(t, g.RestrictsRefs())
+	require.NoError(t, g.IsRefPermitted("refs/heads/main"))
+}
+
+func TestRefsRestrictApiRequests(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.GitLabProviderType,
+				Host:     "gitlab.com",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Name:        "repo",
+						Namespaces:  []*config.Namespace{{Name: "default"}},
+						AllowedRefs: []string{"refs/heads/flux-image-updates/*"},
+					},
+					{
+						Name:        "policy",
+						Namespaces:  []*config.Namespace{{Name: "default"}},
+						AllowedRefs: []string{"refs/heads/flux-image-updates/*"},
+						Policy: config.Policy{
+							Rules: []config.PolicyRule{
+								{
+									Name:    "merge-requests",
+									Methods: []string{http.MethodPost},
+									Path:    "/api/v4/projects/{organization}%2F{repository}/merge_requests",
+								},
+							},
+						},
+					},
+					{
+						Name:       "unrestricted",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+			{
+				Provider: config.GitHubProviderType,
+				GitHub:   config.GitHub{Pat: "foo"},
+				Host:     "github.com",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Name:        "repo",
+						Namespaces:  []*config.Namespace{{Name: "default"}},
+						AllowedRefs: []string{"refs/heads/flux-image-updates/*"},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		id     string
+		method string
+		path   string
+		allow  bool
+	}{
+		{
+			name:   "read api",
+			id:     "gitlab.com-org-repo",
+			method: http.MethodGet,
+			path:   "/api/v4/projects/org%2Frepo/repository/branches",
+			allow:  true,
+		},
+		{
+			name:   "modify api permitted by policy rule",
+			id:     "gitlab.com-org-policy",
+			method: http.MethodPost,
+			path:   "/api/v4/projects/org%2Fpolicy/merge_requests",
+			allow:  true,
+		},
+		{
+			name:   "modify api without policy rule",
+			id:     "gitlab.com-org-repo",
+			method: http.MethodDelete,
+			path:   "/api/v4/projects/org%2Frepo/repository/branches/main",
+			allow:  false,
+		},
+		{
+			name:   "push is checked by refs",
+			id:     "gitlab.com-org-repo",
+			method: http.MethodPost,
+			path:   "/org/repo.git/git-receive-pack",
+			allow:  true,
+		},
+		{
+			name:   "modify api permitted by provider default rule",
+			id:     "github.com-org-repo",
+			method: http.MethodPost,
+			path:   "/api/v3/repos/org/repo/pulls",
+			allow:  false,
+		},
+		{
+			name:   "read api permitted by provider default rule",
+			id:     "github.com-org-repo",
+			method: http.MethodGet,
+			path:   "/api/v3/repos/org/repo/pulls",
+			allow:  true,
+		},
+		{
+			name:   "modify api without refs",
+			id:     "gitlab.com-org-unrestricted",
+			method: http.MethodDelete,
+			path:   "/api/v4/projects/org%2Funrestricted/repository/branches/main",
+			allow:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := authz.GetEndpointById(tt.id)
+			require.NoError(t, err)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			err = authz.IsRequestPermitted(req, endpoint.Grants[0].Token)
+			if tt.allow {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+// Reload replaces the configuration of the authorizer. The new endpoints are created and the repository patterns are
+// resolved before anything is replaced, so that the previous configuration is kept if the new one cannot be applied.
+// Endpoints which exist in both configurations keep the tokens of their namespaces. Patterns whose repositories cannot
+// be listed keep their previous endpoints, in the same way as when the repositories are refreshed.
+func (a *Authorizer) Reload(ctx context.Context, cfg *config.Configuration) error {
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+
+	next, err := NewAuthorizer(cfg)
+	if err != nil {
+		return fmt.Errorf("could not generate authorization: %w", err)
+	}
+	// Tokens restored at start for repositories which have not been resolved yet are used by the new endpoints
+	a.mu.RLock()
+	for key, token := range a.restoredTokens {
+		next.restoredTokens[key] = token
+	}
+	next.namespaceLabels = a.namespaceLabels
+	a.mu.RUnlock()
+	if _, err := next.applyNamespaceSelectors(); err != nil {
+		return fmt.Errorf("could not select namespaces: %w", err)
+	}
+	failed, err := next.refreshRepositories(ctx)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).WithName("reload").Error(err, "could not resolve repository patterns, keeping previous repositories")
+	}
+
+	a.mu.Lock()
+	if err := next.keepPatternEndpoints(a, failed); err != nil {
+		a.mu.Unlock()
+		return fmt.Errorf("could not keep repositories of patterns: %w", err)
+	}
+	for _, e := range next.endpoints {
+		prev, ok := a.endpointsByID[e.ID()]
+		if !ok {
+			continue
+		}
+		// The grants of the new endpoints are not shared yet so they can be modified
+		for _, g := range e.Grants {
+			prevGrant, err := prev.GetGrant(g.Namespace)
+			if err != nil {
+				continue
+			}
+			delete(next.grantsByToken, g.Token)
+			g.Token = prevGrant.Token
+			next.grantsByToken[g.Token] = g
+		}
+	}
+	// Previous tokens of a rotation are kept for the grants which still exist
+	for token, expires := range a.expiringTokens {
+		prevGrant := a.grantsByToken[token]
+		e, ok := next.endpointsByID[prevGrant.endpoint.ID()]
+		if !ok {
+			continue
+		}
+		g, err := e.GetGrant(prevGrant.Namespace)
+		if err != nil {
+			continue
+		}
+		next.grantsByToken[token] = g
+		next.expiringTokens[token] = expires
+	}
+	for token, prevToken := range a.unwrittenTokens {
+		_, issued := next.grantsByToken[token]
+		if _, ok := next.expiringTokens[prevToken]; ok && issued {
+			next.unwrittenTokens[token] = prevToken
+		}
+	}
+	a.organizations = next.organizations
+	a.providers = next.providers
+	a.endpoints = next.endpoints
+	a.endpointsByID = next.endpointsByID
+	a.grantsByToken = next.grantsByToken
+	a.expiringTokens = next.expiringTokens
+	a.unwrittenTokens = next.unwrittenTokens
+	a.restoredTokens = next.restoredTokens
+	a.mu.Unlock()
+
+	a.notify()
+	return nil
+}
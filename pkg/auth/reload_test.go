@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func getReloadConfig(host string, repositories ...*config.Repository) *config.Configuration {
+	return &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     host,
+				Scheme:   "http",
+				Name:     "org",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "pat",
+				},
+				Repositories: repositories,
+			},
+		},
+	}
+}
+
+func TestReload(t *testing.T) {
+	repoSrv := &testRepositoryServer{}
+	repoSrv.setNames("team-a-config")
+	srv := httptest.NewServer(repoSrv)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	host := u.Host
+
+	authz, err := NewAuthorizer(getReloadConfig(host,
+		&config.Repository{Project: "proj", Name: "a", Namespaces: []*config.Namespace{{Name: "foo"}, {Name: "bar"}}},
+		&config.Repository{Project: "proj", Name: "b", Namespaces: []*config.Namespace{{Name: "foo"}}},
+		&config.Repository{Project: "proj", Name: "team-*-config", Namespaces: []*config.Namespace{{Name: "teams"}}},
+	))
+	require.NoError(t, err)
+	require.NoError(t, authz.RefreshRepositories(context.TODO()))
+	<-authz.Updated()
+	require.NoError(t, authz.RotateTokens(time.Hour))
+	<-authz.Updated()
+	prevA, err := authz.GetEndpointById(host + "-org-proj-a")
+	require.NoError(t, err)
+	prevB, err := authz.GetEndpointById(host + "-org-proj-b")
+	require.NoError(t, err)
+	prevTeamA, err := authz.GetEndpointById(host + "-org-proj-team-a-config")
+	require.NoError(t, err)
+	prevFoo, err := prevA.GetGrant("foo")
+	require.NoError(t, err)
+	prevBar, err := prevA.GetGrant("bar")
+	require.NoError(t, err)
+
+	err = authz.Reload(context.TODO(), getReloadConfig(host,
+		&config.Repository{Project: "proj", Name: "a", Access: config.ReadAccessLevel, Namespaces: []*config.Namespace{{Name: "foo"}, {Name: "baz"}}},
+		&config.Repository{Project: "proj", Name: "c", Namespaces: []*config.Namespace{{Name: "foo"}}},
+		&config.Repository{Project: "proj", Name: "team-*-config", Namespaces: []*config.Namespace{{Name: "teams"}}},
+	))
+	require.NoError(t, err)
+	<-authz.Updated()
+	require.Len(t, authz.GetEndpoints(), 3)
+
+	// Unchanged namespaces keep their tokens while the new configuration is used
+	a, err := authz.GetEndpointById(host + "-org-proj-a")
+	require.NoError(t, err)
+	foo, err := a.GetGrant("foo")
+	require.NoError(t, err)
+	require.Equal(t, prevFoo.Token, foo.Token)
+	require.Equal(t, config.AccessLevel(config.ReadAccessLevel), foo.access)
+	g, err := authz.GetGrantByToken(prevFoo.Token)
+	require.NoError(t, err)
+	require.Equal(t, foo, g)
+	_, err = a.GetGrant("baz")
+	require.NoError(t, err)
+	require.Error(t, authz.IsPermitted("/org/proj/_git/a", prevBar.Token))
+
+	// Previous tokens of the rotation are still accepted for remaining grants
+	prevFooRotated := ""
+	for token, g := range authz.grantsByToken {
+		if g == foo && token != foo.Token {
+			prevFooRotated = token
+		}
+	}
+	require.NotEmpty(t, prevFooRotated)
+	require.Len(t, authz.expiringTokens, 2)
+
+	// Repositories resolved from patterns keep their tokens
+	teamA, err := authz.GetEndpointById(host + "-org-proj-team-a-config")
+	require.NoError(t, err)
+	require.Equal(t, prevTeamA.Grants[0].Token, teamA.Grants[0].Token)
+	require.NotNil(t, teamA.source)
+
+	_, err = authz.GetEndpointById(host + "-org-proj-b")
+	require.Error(t, err)
+	require.Error(t, authz.IsPermitted("/org/proj/_git/b", prevB.Grants[0].Token))
+	_, err = authz.GetEndpointById(host + "-org-proj-c")
+	require.NoError(t, err)
+
+	// Patterns which cannot be listed keep their previous repositories
+	repoSrv.setFail(true)
+	err = authz.Reload(context.TODO(), getReloadConfig(host,
+		&config.Repository{
+			Project:    "proj",
+			Name:       "team-*-config",
+			Access:     config.ReadAccessLevel,
+			Namespaces: []*config.Namespace{{Name: "teams"}},
+		},
+	))
+	require.NoError(t, err)
+	<-authz.Updated()
+	require.Len(t, authz.GetEndpoints(), 1)
+	teamA, err = authz.GetEndpointById(host + "-org-proj-team-a-config")
+	require.NoError(t, err)
+	require.Equal(t, prevTeamA.Grants[0].Token, teamA.Grants[0].Token)
+	require.Equal(t, config.AccessLevel(config.ReadAccessLevel), teamA.Grants[0].access)
+	require.NoError(t, authz.IsPermitted("/org/proj/_git/team-a-config", teamA.Grants[0].Token))
+
+	// The configuration is kept when the new configuration cannot be applied
+	err = authz.Reload(context.TODO(), &config.Configuration{
+		Organizations: []*config.Organization{{Provider: "unknown", Host: host, Name: "org"}},
+	})
+	require.Error(t, err)
+	require.Len(t, authz.GetEndpoints(), 1)
+	require.Empty(t, authz.Updated())
+}
@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+// repositoryLister is implemented by providers which can list the repositories of an organization or project,
+// which is required to resolve repository patterns.
+type repositoryLister interface {
+	listRepositories(ctx context.Context, client *apiClient, organization, project string) ([]string, error)
+}
+
+// isRepositoryPattern returns true if the repository name is a glob pattern.
+func isRepositoryPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// matchRepositoryPattern matches repository names case insensitive as most providers ignore the case of names.
+func matchRepositoryPattern(pattern, name string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return err == nil && ok
+}
+
+// apiClient sends API requests for an organization through its provider in the same way as proxied requests.
+type apiClient struct {
+	provider Provider
+	endpoint *Endpoint
+	client   *http.Client
+}
+
+func newAPIClient(provider Provider, o *config.Organization) *apiClient {
+	return &apiClient{
+		provider: provider,
+		endpoint: &Endpoint{
+			scheme:       o.Scheme,
+			host:         o.Host,
+			organization: o.Name,
+		},
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// get decodes the JSON response of the API path, which is given in the format expected by the proxy.
+func (c *apiClient) get(ctx context.Context, apiPath string, query url.Values, v any) error {
+	// Parsing the path keeps escaped characters such as the URL encoded slashes of GitLab group paths
+	u, err := url.Parse(c.provider.getPath(c.endpoint, apiPath))
+	if err != nil {
+		return err
+	}
+	u.Scheme = c.endpoint.scheme
+	u.Host = c.provider.getHost(c.endpoint, apiPath)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	authorizationHeader, err := c.provider.getAuthorizationHeader(ctx, apiPath)
+	if err != nil {
+		return err
+	}
+	if authorizationHeader != "" {
+		req.Header.Set("Authorization", authorizationHeader)
+	}
+	if ra, ok := c.provider.(requestAuthorizer); ok {
+		if err := ra.authorizeRequest(ctx, req); err != nil {
+			return err
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %s from %s", resp.Status, u.Path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// listPages calls the page function with increasing page numbers until it returns fewer names than the page size.
+func listPages(pageSize int, page func(page int) ([]string, error)) ([]string, error) {
+	names := []string{}
+	for i := 1; ; i++ {
+		pageNames, err := page(i)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, pageNames...)
+		if len(pageNames) < pageSize {
+			return names, nil
+		}
+	}
+}
+
+// RefreshRepositories resolves the repository patterns into endpoints. Endpoints of repositories which are no longer
+// listed are removed, while existing endpoints keep their tokens. Endpoints of a pattern are kept if its repositories
+// cannot be listed.
+func (a *Authorizer) RefreshRepositories(ctx context.Context) error {
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+
+	_, err := a.refreshRepositories(ctx)
+	return err
+}
+
+// refreshRepositories resolves the repository patterns and returns the patterns whose repositories could not be listed.
+// The caller has to hold the refresh lock.
+func (a *Authorizer) refreshRepositories(ctx context.Context) (map[*config.Repository]bool, error) {
+	type resolved struct {
+		org     *organization
+		pattern *config.Repository
+		repo    *config.Repository
+	}
+	desired := map[string]resolved{}
+	failed := map[*config.Repository]bool{}
+	errs := []error{}
+	for _, org := range a.organizations {
+		lister, ok := org.provider.(repositoryLister)
+		if !ok || len(org.patterns) == 0 {
+			continue
+		}
+		client := newAPIClient(org.provider, org.cfg)
+		names := map[string][]string{}
+		for _, pattern := range org.patterns {
+			if _, ok := names[pattern.Project]; !ok {
+				projectNames, err := lister.listRepositories(ctx, client, org.cfg.Name, pattern.Project)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("could not list repositories for %s: %w", pattern.Name, err))
+					failed[pattern] = true
+					continue
+				}
+				names[pattern.Project] = projectNames
+			}
+			for _, name := range names[pattern.Project] {
+				if !matchRepositoryPattern(pattern.Name, name) {
+					continue
+				}
+				repo := *pattern
+				repo.Name = name
+				e := &Endpoint{host: org.cfg.Host, organization: org.cfg.Name, project: repo.Project, repository: repo.Name}
+				// The first pattern which matches a repository is used
+				if _, ok := desired[e.ID()]; ok {
+					continue
+				}
+				desired[e.ID()] = resolved{org: org, pattern: pattern, repo: &repo}
+			}
+		}
+	}
+
+	a.mu.Lock()
+	changed := false
+	for id, res := range desired {
+		if _, ok := a.endpointsByID[id]; ok {
+			continue
+		}
+		e, err := newEndpoint(res.org.provider, res.org.cfg, res.repo)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		e.source = res.pattern
+		if err := a.addEndpoint(e, res.org.provider); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changed = true
+	}
+	for _, e := range slices.Clone(a.endpoints) {
+		if e.source == nil || failed[e.source] {
+			continue
+		}
+		if _, ok := desired[e.ID()]; ok {
+			continue
+		}
+		a.removeEndpoint(e)
+		changed = true
+	}
+	a.mu.Unlock()
+
+	if changed {
+		a.notify()
+	}
+	return failed, errors.Join(errs...)
+}
+
+// keepPatternEndpoints adds the endpoints of the previous authorizer which were resolved from a pattern that could not be
+// listed, so that the repositories are kept until the pattern can be listed again. The patterns are matched by
+// organization, project and name as the new configuration has different instances. The caller has to hold the lock of
+// the previous authorizer.
+func (a *Authorizer) keepPatternEndpoints(prev *Authorizer, failed map[*config.Repository]bool) error {
+	errs := []error{}
+	for _, org := range a.organizations {
+		for _, pattern := range org.patterns {
+			if !failed[pattern] {
+				continue
+			}
+			for _, prevEndpoint := range prev.endpoints {
+				if prevEndpoint.source == nil || prevEndpoint.host != org.cfg.Host || prevEndpoint.organization != org.cfg.Name ||
+					prevEndpoint.source.Project != pattern.Project || prevEndpoint.source.Name != pattern.Name {
+					continue
+				}
+				if _, ok := a.endpointsByID[prevEndpoint.ID()]; ok {
+					continue
+				}
+				repo := *pattern
+				repo.Name = prevEndpoint.repository
+				e, err := newEndpoint(org.provider, org.cfg, &repo)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				e.source = pattern
+				if err := a.addEndpoint(e, org.provider); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *Authorizer) hasPatterns() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, org := range a.organizations {
+		if len(org.patterns) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RunRepositoryRefresh refreshes the repositories at the given interval until the context is cancelled. Refreshing is
+// disabled when the interval is zero or negative, and skipped while no repository patterns are configured as patterns
+// may be added when the configuration is reloaded.
+func (a *Authorizer) RunRepositoryRefresh(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	log := logr.FromContextOrDiscard(ctx).WithName("repositories")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if a.hasPatterns() {
+			if err := a.RefreshRepositories(ctx); err != nil {
+				log.Error(err, "could not refresh repositories")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestMatchRepositoryPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{pattern: "*", name: "repo", match: true},
+		{pattern: "team-*-config", name: "team-a-config", match: true},
+		{pattern: "team-*-config", name: "Team-A-Config", match: true},
+		{pattern: "team-*-config", name: "team-a-configs", match: false},
+		{pattern: "repo-?", name: "repo-1", match: true},
+		{pattern: "repo-[ab]", name: "repo-c", match: false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.pattern, tt.name), func(t *testing.T) {
+			require.True(t, isRepositoryPattern(tt.pattern))
+			require.Equal(t, tt.match, matchRepositoryPattern(tt.pattern, tt.name))
+		})
+	}
+	require.False(t, isRepositoryPattern("repo"))
+}
+
+type testRepositoryServer struct {
+	mu    sync.Mutex
+	names []string
+	fail  bool
+}
+
+func (s *testRepositoryServer) setNames(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = names
+}
+
+func (s *testRepositoryServer) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *testRepositoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail || r.URL.Path != "/org/proj/_apis/git/repositories" || r.Header.Get("Authorization") == "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	values := []map[string]string{}
+	for _, name := range s.names {
+		values = append(values, map[string]string{"name": name})
+	}
+	//nolint:errcheck // ignore
+	json.NewEncoder(w).Encode(map[string]any{"value": values})
+}
+
+func getPatternAuthorizer(t *testing.T, srv *httptest.Server) *Authorizer {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     u.Host,
+				Scheme:   u.Scheme,
+				Name:     "org",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "pat",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "static",
+						Namespaces: []*config.Namespace{{Name: "static"}},
+					},
+					{
+						Project:    "proj",
+						Name:       "team-*-config",
+						Namespaces: []*config.Namespace{{Name: "teams"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	return authz
+}
+
+func TestRefreshRepositories(t *testing.T) {
+	repoSrv := &testRepositoryServer{}
+	repoSrv.setNames("static", "team-a-config", "team-b-config", "other")
+	srv := httptest.NewServer(repoSrv)
+	defer srv.Close()
+	authz := getPatternAuthorizer(t, srv)
+	host := srv.Listener.Addr().String()
+
+	require.Len(t, authz.GetEndpoints(), 1)
+	err := authz.RefreshRepositories(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, authz.GetEndpoints(), 3)
+	<-authz.Updated()
+
+	teamA, err := authz.GetEndpointById(host + "-org-proj-team-a-config")
+	require.NoError(t, err)
+	require.Equal(t, "org-proj-team-a-config", teamA.SecretName)
+	require.Equal(t, "teams", teamA.Grants[0].Namespace)
+	err = authz.IsPermitted("/org/proj/_git/team-a-config", teamA.Grants[0].Token)
+	require.NoError(t, err)
+	err = authz.IsPermitted("/org/proj/_git/team-b-config", teamA.Grants[0].Token)
+	require.Error(t, err)
+	_, err = authz.GetEndpointById(host + "-org-proj-other")
+	require.Error(t, err)
+
+	// Existing endpoints keep their tokens and nothing is updated
+	err = authz.RefreshRepositories(context.TODO())
+	require.NoError(t, err)
+	teamAAgain, err := authz.GetEndpointById(host + "-org-proj-team-a-config")
+	require.NoError(t, err)
+	require.Equal(t, teamA.Grants[0].Token, teamAAgain.Grants[0].Token)
+	require.Empty(t, authz.Updated())
+
+	// Endpoints are kept when listing fails
+	repoSrv.setFail(true)
+	err = authz.RefreshRepositories(context.TODO())
+	require.Error(t, err)
+	require.Len(t, authz.GetEndpoints(), 3)
+
+	// Removed repositories are removed together with their tokens, configured repositories are kept
+	repoSrv.setFail(false)
+	repoSrv.setNames("team-b-config")
+	err = authz.RefreshRepositories(context.TODO())
+	require.NoError(t, err)
+	<-authz.Updated()
+	require.Len(t, authz.GetEndpoints(), 2)
+	_, err = authz.GetEndpointById(host + "-org-proj-team-a-config")
+	require.Error(t, err)
+	_, err = authz.GetEndpointById(host + "-org-proj-static")
+	require.NoError(t, err)
+	err = authz.IsPermitted("/org/proj/_git/team-a-config", teamA.Grants[0].Token)
+	require.Error(t, err)
+}
+
+func TestRunRepositoryRefresh(t *testing.T) {
+	repoSrv := &testRepositoryServer{}
+	repoSrv.setNames("static", "team-a-config")
+	srv := httptest.NewServer(repoSrv)
+	defer srv.Close()
+	authz := getPatternAuthorizer(t, srv)
+
+	// Refreshing is disabled for intervals which are not positive
+	require.NoError(t, authz.RunRepositoryRefresh(context.TODO(), 0))
+	require.NoError(t, authz.RunRepositoryRefresh(context.TODO(), -time.Minute))
+	require.Len(t, authz.GetEndpoints(), 1)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- authz.RunRepositoryRefresh(ctx, time.Hour)
+	}()
+	<-authz.Updated()
+	require.Len(t, authz.GetEndpoints(), 2)
+	cancel()
+	require.NoError(t, <-errCh)
+
+	// Nothing is refreshed without patterns
+	authz, err := NewAuthorizer(&config.Configuration{Organizations: []*config.Organization{}})
+	require.NoError(t, err)
+	require.False(t, authz.hasPatterns())
+	ctx, cancel = context.WithCancel(context.TODO())
+	cancel()
+	require.NoError(t, authz.RunRepositoryRefresh(ctx, time.Hour))
+}
+
+func TestRepositoryPatternNotSupported(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.GenericProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Generic: config.Generic{
+					GitPaths: []string{"/{organization}/{repository}"},
+					Auth:     config.GenericAuth{Type: config.GenericBearerAuthType},
+				},
+				Repositories: []*config.Repository{
+					{
+						Name:       "*",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	_, err := NewAuthorizer(cfg)
+	require.Error(t, err)
+
+	cfg.Organizations[0] = &config.Organization{
+		Provider: config.AzureDevOpsProviderType,
+		Host:     "foo",
+		Name:     "org",
+		Repositories: []*config.Repository{
+			{
+				Project:            "proj",
+				Name:               "*",
+				Namespaces:         []*config.Namespace{{Name: "default"}},
+				SecretNameOverride: "git-auth",
+			},
+		},
+	}
+	_, err = NewAuthorizer(cfg)
+	require.Error(t, err)
+}
+
+func TestListRepositories(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		project  string
+		path     string
+		response string
+	}{
+		{
+			name:     "github",
+			provider: &github{itr: &staticTokenSource{token: "token"}},
+			path:     "/api/v3/orgs/org/repos",
+			response: `[{"name": "repo"}]`,
+		},
+		{
+			name:     "gitlab",
+			provider: newGitlab("token"),
+			project:  "sub/group",
+			path:     "/api/v4/groups/org%2Fsub%2Fgroup/projects",
+			response: `[{"path": "repo"}]`,
+		},
+		{
+			name:     "gitea",
+			provider: newGitea("token"),
+			path:     "/api/v1/orgs/org/repos",
+			response: `[{"name": "repo"}]`,
+		},
+		{
+			name:     "bitbucket server",
+			provider: newBitbucketServer("token"),
+			project:  "PROJ",
+			path:     "/rest/api/1.0/projects/PROJ/repos",
+			response: `{"values": [{"slug": "repo"}], "isLastPage": true}`,
+		},
+		{
+			name:     "bitbucket cloud",
+			provider: newBitbucketCloud("token"),
+			path:     "/2.0/repositories/org",
+			response: `{"values": [{"slug": "repo"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.EscapedPath() != tt.path || r.Header.Get("Authorization") == "" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				fmt.Fprint(w, tt.response)
+			}))
+			defer srv.Close()
+			u, err := url.Parse(srv.URL)
+			require.NoError(t, err)
+
+			client := newAPIClient(tt.provider, &config.Organization{Scheme: u.Scheme, Host: u.Host, Name: "org"})
+			lister, ok := tt.provider.(repositoryLister)
+			require.True(t, ok)
+			names, err := lister.listRepositories(context.TODO(), client, "org", tt.project)
+			require.NoError(t, err)
+			require.Equal(t, []string{"repo"}, names)
+		})
+	}
+}
+
+func TestListPages(t *testing.T) {
+	pages := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	names, err := listPages(2, func(page int) ([]string, error) {
+		return pages[page-1], nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, names)
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tokenRotationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "git_auth_proxy_token_rotations_total",
+		Help: "The number of times all tokens have been rotated.",
+	})
+	tokenRotationTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "git_auth_proxy_token_rotation_timestamp_seconds",
+		Help: "The time of the last token rotation in seconds since the epoch.",
+	})
+	tokenRevocationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "git_auth_proxy_token_revocations_total",
+		Help: "The number of tokens which have been revoked.",
+	})
+)
+
+// RotateTokens issues new tokens for all grants. The previous tokens are accepted until the grace period has passed
+// so that requests which are in progress, or clients which have not read the new secret yet, are not interrupted.
+// Previous tokens are accepted after the grace period until the new token has been written to the secret.
+func (a *Authorizer) RotateTokens(gracePeriod time.Duration) error {
+	a.mu.Lock()
+	now := a.now()
+	for i, e := range a.endpoints {
+		// Endpoints are replaced instead of modified as they are read without holding the lock
+		rotated, err := e.withNewTokens(func(*Grant) bool { return true })
+		if err != nil {
+			a.mu.Unlock()
+			return fmt.Errorf("could not rotate tokens for %s: %w", e.ID(), err)
+		}
+		a.endpoints[i] = rotated
+		a.endpointsByID[rotated.ID()] = rotated
+		for j, g := range e.Grants {
+			if gracePeriod > 0 {
+				a.expiringTokens[g.Token] = now.Add(gracePeriod)
+				// Grants of service accounts do not have a secret which the new token is written to
+				if !g.UsesServiceAccounts() {
+					a.unwrittenTokens[rotated.Grants[j].Token] = g.Token
+				}
+				continue
+			}
+			delete(a.grantsByToken, g.Token)
+		}
+		for _, g := range rotated.Grants {
+			a.grantsByToken[g.Token] = g
+		}
+	}
+	// Expired tokens are removed after rotating, as previous tokens are kept until the tokens replacing them are written
+	a.removeExpiredTokens(now)
+	a.mu.Unlock()
+
+	tokenRotationsTotal.Inc()
+	tokenRotationTimestamp.Set(float64(now.Unix()))
+	a.notify()
+	return nil
+}
+
+// RevokeToken revokes the token of the namespace for the endpoint and issues a new token, all namespaces of the endpoint
+// are revoked when the namespace is empty. Previous tokens which are still accepted after a rotation are revoked as well.
+func (a *Authorizer) RevokeToken(id, namespace string) error {
+	revoke := func(g *Grant) bool {
+		return namespace == "" || g.Namespace == namespace
+	}
+
+	a.mu.Lock()
+	e, ok := a.endpointsByID[id]
+	if !ok {
+		a.mu.Unlock()
+		return fmt.Errorf("endpoint not found for id %s", id)
+	}
+	if namespace != "" {
+		if _, err := e.GetGrant(namespace); err != nil {
+			a.mu.Unlock()
+			return err
+		}
+	}
+	rotated, err := e.withNewTokens(revoke)
+	if err != nil {
+		a.mu.Unlock()
+		return fmt.Errorf("could not revoke token for %s: %w", id, err)
+	}
+	revoked := a.replaceEndpoint(e, rotated, revoke)
+	a.mu.Unlock()
+
+	tokenRevocationsTotal.Add(float64(revoked))
+	a.notify()
+	return nil
+}
+
+// RunTokenRotation rotates the tokens at the given interval until the context is cancelled. Rotation is disabled
+// when the interval is zero or negative.
+func (a *Authorizer) RunTokenRotation(ctx context.Context, interval, gracePeriod time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	log := logr.FromContextOrDiscard(ctx).WithName("rotation")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := a.RotateTokens(gracePeriod); err != nil {
+				log.Error(err, "could not rotate tokens")
+				continue
+			}
+			log.Info("rotated tokens")
+		}
+	}
+}
+
+// TokenWritten marks the token as written to the secret of its grant, so that the previous token of the grant expires
+// after its grace period.
+func (a *Authorizer) TokenWritten(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.unwrittenTokens, token)
+}
+
+// isTokenExpired returns true if the previous token has passed its grace period and the token which replaced it has been
+// written, the caller has to hold the lock.
+func (a *Authorizer) isTokenExpired(token string, now time.Time) bool {
+	expires, ok := a.expiringTokens[token]
+	if !ok || now.Before(expires) {
+		return false
+	}
+	for next, prev := range a.unwrittenTokens {
+		if prev != token {
+			continue
+		}
+		// Tokens which have been revoked before they were written do not keep the previous token
+		if _, ok := a.grantsByToken[next]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// removeExpiredTokens revokes previous tokens after their grace period, the caller has to hold the lock.
+func (a *Authorizer) removeExpiredTokens(now time.Time) {
+	for token := range a.expiringTokens {
+		if !a.isTokenExpired(token, now) {
+			continue
+		}
+		delete(a.expiringTokens, token)
+		delete(a.grantsByToken, token)
+	}
+	for next, prev := range a.unwrittenTokens {
+		_, nextOk := a.grantsByToken[next]
+		_, prevOk := a.grantsByToken[prev]
+		if !nextOk || !prevOk {
+			delete(a.unwrittenTokens, next)
+		}
+	}
+}
+
+// withNewTokens returns a copy of the endpoint where the grants matching the filter have a new token.
+func (e *Endpoint) withNewTokens(filter func(g *Grant) bool) (*Endpoint, error) {
+	rotated := *e
+	rotated.Grants = make([]*Grant, 0, len(e.Grants))
+	for _, g := range e.Grants {
+		grant := *g
+		grant.endpoint = &rotated
+		if filter(g) {
+			token, err := randomSecureToken()
+			if err != nil {
+				return nil, fmt.Errorf("could not generate random token: %w", err)
+			}
+			grant.Token = token
+		}
+		rotated.Grants = append(rotated.Grants, &grant)
+	}
+	return &rotated, nil
+}
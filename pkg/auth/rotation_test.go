@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestRotateTokens(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}, {Name: "bar"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	now := time.Now()
+	authz.now = func() time.Time { return now }
+	path := "/org/proj/_git/repo"
+
+	before, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	rotations := testutil.ToFloat64(tokenRotationsTotal)
+	err = authz.RotateTokens(time.Hour)
+	require.NoError(t, err)
+	<-authz.Updated()
+	require.InEpsilon(t, rotations+1, testutil.ToFloat64(tokenRotationsTotal), 0)
+	require.InEpsilon(t, float64(now.Unix()), testutil.ToFloat64(tokenRotationTimestamp), 0)
+
+	after, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.Len(t, after.Grants, 2)
+	for i, g := range after.Grants {
+		require.Equal(t, before.Grants[i].Namespace, g.Namespace)
+		require.NotEqual(t, before.Grants[i].Token, g.Token)
+		require.Equal(t, after, g.Endpoint())
+		require.NoError(t, authz.IsPermitted(path, g.Token))
+		// Previous tokens are accepted during the grace period
+		require.NoError(t, authz.IsPermitted(path, before.Grants[i].Token))
+	}
+
+	// Previous tokens expire after the grace period once the new token has been written
+	authz.TokenWritten(after.Grants[0].Token)
+	now = now.Add(time.Hour)
+	for _, g := range after.Grants {
+		require.NoError(t, authz.IsPermitted(path, g.Token))
+	}
+	require.Error(t, authz.IsPermitted(path, before.Grants[0].Token))
+	require.NoError(t, authz.IsPermitted(path, before.Grants[1].Token))
+	authz.TokenWritten(after.Grants[1].Token)
+	require.Error(t, authz.IsPermitted(path, before.Grants[1].Token))
+
+	// Previous tokens are revoked directly without a grace period
+	err = authz.RotateTokens(0)
+	require.NoError(t, err)
+	for _, g := range after.Grants {
+		require.Error(t, authz.IsPermitted(path, g.Token))
+	}
+	require.Len(t, authz.grantsByToken, 2)
+	require.Empty(t, authz.expiringTokens)
+	require.Empty(t, authz.unwrittenTokens)
+
+	// Rotation is disabled for intervals which are not positive
+	require.NoError(t, authz.RunTokenRotation(context.TODO(), 0, time.Hour))
+	require.NoError(t, authz.RunTokenRotation(context.TODO(), -time.Hour, time.Hour))
+}
+
+func TestRevokeToken(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}, {Name: "bar"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	path := "/org/proj/_git/repo"
+
+	first, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	// Previous tokens from a rotation are revoked as well
+	err = authz.RotateTokens(time.Hour)
+	require.NoError(t, err)
+	<-authz.Updated()
+	before, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+
+	revocations := testutil.ToFloat64(tokenRevocationsTotal)
+	err = authz.RevokeToken("foo-org-proj-repo", "foo")
+	require.NoError(t, err)
+	<-authz.Updated()
+	require.InEpsilon(t, revocations+2, testutil.ToFloat64(tokenRevocationsTotal), 0)
+	after, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.Error(t, authz.IsPermitted(path, first.Grants[0].Token))
+	require.Error(t, authz.IsPermitted(path, before.Grants[0].Token))
+	require.NotEqual(t, before.Grants[0].Token, after.Grants[0].Token)
+	require.NoError(t, authz.IsPermitted(path, after.Grants[0].Token))
+	// Other namespaces keep their tokens
+	require.Equal(t, before.Grants[1].Token, after.Grants[1].Token)
+	require.NoError(t, authz.IsPermitted(path, first.Grants[1].Token))
+	g, err := authz.GetGrantByToken(after.Grants[1].Token)
+	require.NoError(t, err)
+	require.Equal(t, after, g.Endpoint())
+
+	err = authz.RevokeToken("foo-org-proj-repo", "")
+	require.NoError(t, err)
+	for _, g := range after.Grants {
+		require.Error(t, authz.IsPermitted(path, g.Token))
+	}
+	require.Error(t, authz.IsPermitted(path, first.Grants[1].Token))
+
+	require.Error(t, authz.RevokeToken("foo-org-proj-other", ""))
+	require.Error(t, authz.RevokeToken("foo-org-proj-repo", "other"))
+}
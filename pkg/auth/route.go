@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// route permits requests to a path template and its sub paths. All methods are permitted when no methods are set.
+type route struct {
+	raw     string
+	methods []string
+	regex   *regexp.Regexp
+}
+
+// parseRoute parses routes in the format "[METHOD,...] <path>", where the path may contain the same placeholders
+// as the generic provider paths.
+func parseRoute(raw, organization, project, repository string) (*route, error) {
+	fields := strings.Fields(raw)
+	switch len(fields) {
+	case 1:
+		return newRoute(nil, fields[0], organization, project, repository)
+	case 2:
+		return newRoute(strings.Split(fields[0], ","), fields[1], organization, project, repository)
+	default:
+		return nil, fmt.Errorf("invalid route %q", raw)
+	}
+}
+
+func newRoute(methods []string, tpl, organization, project, repository string) (*route, error) {
+	raw := tpl
+	if len(methods) > 0 {
+		raw = fmt.Sprintf("%s %s", strings.Join(methods, ","), tpl)
+	}
+	if !strings.HasPrefix(tpl, "/") {
+		return nil, fmt.Errorf("route path has to start with a slash %q", raw)
+	}
+	regex, err := compilePathTemplate(tpl, organization, project, repository)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route %q: %w", raw, err)
+	}
+	upperMethods := []string{}
+	for _, method := range methods {
+		upperMethods = append(upperMethods, strings.ToUpper(method))
+	}
+	return &route{
+		raw:     raw,
+		methods: upperMethods,
+		regex:   regex,
+	}, nil
+}
+
+func parseRoutes(raws []string, organization, project, repository string) ([]*route, error) {
+	routes := []*route{}
+	for _, raw := range raws {
+		r, err := parseRoute(raw, organization, project, repository)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func (r *route) matches(req *http.Request) bool {
+	if len(r.methods) > 0 && !slices.Contains(r.methods, req.Method) {
+		return false
+	}
+	return r.regex.MatchString(req.URL.EscapedPath())
+}
+
+// isRoutePermitted checks that API requests match one of the routes. All requests are permitted when no routes are set.
+func isRoutePermitted(routes []*route, req *http.Request) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	for _, r := range routes {
+		if r.matches(req) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s does not match any allowed route", req.Method, req.URL.EscapedPath())
+}
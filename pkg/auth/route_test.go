@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   string
+		method  string
+		path    string
+		valid   bool
+		matches bool
+	}{
+		{
+			name:    "any method",
+			route:   "/{organization}/{project}/_apis/git/repositories/{repository}/pullrequests",
+			method:  http.MethodPost,
+			path:    "/org/proj/_apis/git/repositories/repo/pullrequests",
+			valid:   true,
+			matches: true,
+		},
+		{
+			name:    "sub path",
+			route:   "GET /{organization}/{project}/_apis/git/repositories/{repository}/pullrequests",
+			method:  http.MethodGet,
+			path:    "/org/proj/_apis/git/repositories/repo/pullrequests/1",
+			valid:   true,
+			matches: true,
+		},
+		{
+			name:    "lower case methods",
+			route:   "get,post /{organization}/{project}/_apis/git/repositories/{repository}/pullrequests",
+			method:  http.MethodPost,
+			path:    "/org/proj/_apis/git/repositories/repo/pullrequests",
+			valid:   true,
+			matches: true,
+		},
+		{
+			name:    "wrong method",
+			route:   "GET /{organization}/{project}/_apis/git/repositories/{repository}/pullrequests",
+			method:  http.MethodDelete,
+			path:    "/org/proj/_apis/git/repositories/repo/pullrequests",
+			valid:   true,
+			matches: false,
+		},
+		{
+			name:    "wrong path",
+			route:   "GET /{organization}/{project}/_apis/git/repositories/{repository}/pullrequests",
+			method:  http.MethodGet,
+			path:    "/org/proj/_apis/git/repositories/repo/commits",
+			valid:   true,
+			matches: false,
+		},
+		{
+			name:  "relative path",
+			route: "GET _apis",
+			valid: false,
+		},
+		{
+			name:  "too many fields",
+			route: "GET /_apis foo",
+			valid: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRoute(tt.route, "org", "proj", "repo")
+			if !tt.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			require.Equal(t, tt.matches, r.matches(req))
+		})
+	}
+}
+
+func TestNamespaceGrants(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Project: "proj",
+						Name:    "repo",
+						Access:  config.WriteAccessLevel,
+						Namespaces: []*config.Namespace{
+							{
+								Name: "foo",
+							},
+							{
+								Name:   "bar",
+								Access: config.ReadAccessLevel,
+							},
+							{
+								Name:          "baz",
+								AllowedRoutes: []string{"GET /{organization}/{project}/_apis/git/repositories/{repository}/pullrequests"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.Len(t, endpoint.Grants, 3)
+	require.NotEqual(t, endpoint.Grants[0].Token, endpoint.Grants[1].Token)
+	require.NotEqual(t, endpoint.Grants[1].Token, endpoint.Grants[2].Token)
+
+	for _, g := range endpoint.Grants {
+		grant, err := authz.GetGrantByToken(g.Token)
+		require.NoError(t, err)
+		require.Equal(t, g.Namespace, grant.Namespace)
+		e, err := authz.GetEndpointByToken(g.Token)
+		require.NoError(t, err)
+		require.Equal(t, endpoint, e)
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		method    string
+		path      string
+		allow     bool
+	}{
+		{
+			name:      "write namespace can push",
+			namespace: "foo",
+			method:    http.MethodPost,
+			path:      "/org/proj/_git/repo/git-receive-pack",
+			allow:     true,
+		},
+		{
+			name:      "read namespace cannot push",
+			namespace: "bar",
+			method:    http.MethodPost,
+			path:      "/org/proj/_git/repo/git-receive-pack",
+			allow:     false,
+		},
+		{
+			name:      "read namespace can fetch",
+			namespace: "bar",
+			method:    http.MethodPost,
+			path:      "/org/proj/_git/repo/git-upload-pack",
+			allow:     true,
+		},
+		{
+			name:      "routes do not restrict git",
+			namespace: "baz",
+			method:    http.MethodPost,
+			path:      "/org/proj/_git/repo/git-receive-pack",
+			allow:     true,
+		},
+		{
+			name:      "allowed route",
+			namespace: "baz",
+			method:    http.MethodGet,
+			path:      "/org/proj/_apis/git/repositories/repo/pullrequests",
+			allow:     true,
+		},
+		{
+			name:      "route not allowed",
+			namespace: "baz",
+			method:    http.MethodGet,
+			path:      "/org/proj/_apis/git/repositories/repo/commits",
+			allow:     false,
+		},
+		{
+			name:      "route not allowed for api ending with git path",
+			namespace: "baz",
+			method:    http.MethodGet,
+			path:      "/org/proj/_apis/git/repositories/repo/commits/info/refs",
+			allow:     false,
+		},
+		{
+			name:      "route not allowed for api containing lfs path",
+			namespace: "baz",
+			method:    http.MethodGet,
+			path:      "/org/proj/_apis/git/repositories/repo/info/lfs/objects",
+			allow:     false,
+		},
+		{
+			name:      "no routes allow all api requests",
+			namespace: "foo",
+			method:    http.MethodGet,
+			path:      "/org/proj/_apis/git/repositories/repo/commits",
+			allow:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := endpoint.GetGrant(tt.namespace)
+			require.NoError(t, err)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			err = authz.IsRequestPermitted(req, g.Token)
+			if tt.allow {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
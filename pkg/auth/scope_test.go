@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestScopes(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "dev.azure.com",
+				Name:     "org",
+				Scopes: []*config.Scope{
+					{
+						Project:    "proj",
+						Namespaces: []*config.Namespace{{Name: "project"}},
+					},
+					{
+						Project:    config.AnyProject,
+						Namespaces: []*config.Namespace{{Name: "organization"}},
+						Access:     config.ReadAccessLevel,
+					},
+				},
+			},
+			{
+				Provider: config.GitHubProviderType,
+				Host:     "github.com",
+				Name:     "org",
+				GitHub: config.GitHub{
+					Pat: "pat",
+				},
+				Scopes: []*config.Scope{
+					{
+						Namespaces: []*config.Namespace{{Name: "github"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+
+	project, err := authz.GetEndpointById("dev.azure.com-org-proj-*")
+	require.NoError(t, err)
+	require.True(t, project.IsScope())
+	require.Equal(t, "org-proj", project.SecretName)
+	organization, err := authz.GetEndpointById("dev.azure.com-org-*-*")
+	require.NoError(t, err)
+	require.Equal(t, "org", organization.SecretName)
+	github, err := authz.GetEndpointById("github.com-org-*")
+	require.NoError(t, err)
+	require.Equal(t, "org", github.SecretName)
+
+	tests := []struct {
+		name     string
+		endpoint *Endpoint
+		method   string
+		path     string
+		allow    bool
+	}{
+		{
+			name:     "project scope repository",
+			endpoint: project,
+			method:   http.MethodGet,
+			path:     "/org/proj/_git/repo/info/refs",
+			allow:    true,
+		},
+		{
+			name:     "project scope other repository",
+			endpoint: project,
+			method:   http.MethodPost,
+			path:     "/org/proj/_git/other/git-receive-pack",
+			allow:    true,
+		},
+		{
+			name:     "project scope pull requests",
+			endpoint: project,
+			method:   http.MethodPost,
+			path:     "/org/proj/_apis/git/repositories/repo/pullrequests",
+			allow:    true,
+		},
+		{
+			name:     "project scope other project",
+			endpoint: project,
+			method:   http.MethodGet,
+			path:     "/org/other/_git/repo/info/refs",
+			allow:    false,
+		},
+		{
+			name:     "project scope other organization",
+			endpoint: project,
+			method:   http.MethodGet,
+			path:     "/other/proj/_git/repo/info/refs",
+			allow:    false,
+		},
+		{
+			name:     "organization scope any project",
+			endpoint: organization,
+			method:   http.MethodGet,
+			path:     "/org/other/_git/repo/info/refs",
+			allow:    true,
+		},
+		{
+			name:     "organization scope read only",
+			endpoint: organization,
+			method:   http.MethodPost,
+			path:     "/org/other/_git/repo/git-receive-pack",
+			allow:    false,
+		},
+		{
+			name:     "github organization scope",
+			endpoint: github,
+			method:   http.MethodGet,
+			path:     "/org/repo/info/refs",
+			allow:    true,
+		},
+		{
+			name:     "github organization scope api",
+			endpoint: github,
+			method:   http.MethodGet,
+			path:     "/api/v3/repos/org/repo/pulls",
+			allow:    true,
+		},
+		{
+			name:     "github organization scope other organization",
+			endpoint: github,
+			method:   http.MethodGet,
+			path:     "/other/repo/info/refs",
+			allow:    false,
+		},
+		{
+			name:     "github organization scope repository named like organization",
+			endpoint: github,
+			method:   http.MethodGet,
+			path:     "/other/org/info/refs",
+			allow:    false,
+		},
+		{
+			name:     "github organization scope api repository named like organization",
+			endpoint: github,
+			method:   http.MethodGet,
+			path:     "/api/v3/repos/other/org/pulls",
+			allow:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			err := authz.IsRequestPermitted(req, tt.endpoint.Grants[0].Token)
+			if tt.allow {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPathSegment(t *testing.T) {
+	gitlab := newGitlab("token")
+	regexes, err := gitlab.getPathRegex("org", "sub/group", anyPathSegment)
+	require.NoError(t, err)
+	match := func(path string) bool {
+		for _, r := range regexes {
+			if r.MatchString(path) {
+				return true
+			}
+		}
+		return false
+	}
+	require.True(t, match("/org/sub/group/repo.git/info/refs"))
+	require.True(t, match("/api/v4/projects/org%2Fsub%2Fgroup%2Frepo/merge_requests"))
+	require.False(t, match("/api/v4/projects/org%2Fsub%2Fgroup%2Fnested%2Frepo/merge_requests"))
+	require.False(t, match("/org/sub/other/repo.git/info/refs"))
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// anyServiceAccount permits all service accounts in the namespace of a grant.
+	anyServiceAccount      = "*"
+	serviceAccountPrefix   = "system:serviceaccount:"
+	serviceAccountCacheTTL = time.Minute
+	// Rejected tokens are cached for a shorter time so that tokens which have just been created are accepted quickly.
+	serviceAccountNegativeCacheTTL = 10 * time.Second
+	// serviceAccountReviewRate limits the number of TokenReviews per second for each source, so that unauthenticated clients
+	// cannot overload the API server by sending different tokens. Sources have separate limits so that one client cannot
+	// use up the reviews of all other clients.
+	serviceAccountReviewRate  = 10
+	serviceAccountReviewBurst = 20
+	// serviceAccountLimiterTTL is how long the limiter of a source is kept after its last review.
+	serviceAccountLimiterTTL = 10 * time.Minute
+)
+
+var (
+	// ErrTooManyTokenReviews is returned when the source of a request has exceeded its rate of token reviews.
+	ErrTooManyTokenReviews = errors.New("too many token reviews")
+	// ErrTokenReviewFailed is returned when the TokenReview API could not be used, which is different from the token being rejected.
+	ErrTokenReviewFailed = errors.New("could not review token")
+)
+
+// ServiceAccountAuthenticator authenticates Kubernetes service account tokens with the TokenReview API.
+type ServiceAccountAuthenticator struct {
+	client    kubernetes.Interface
+	audiences []string
+	now       func() time.Time
+	newLimit  func() *rate.Limiter
+
+	mu       sync.Mutex
+	cache    map[string]serviceAccountCacheEntry
+	limiters map[string]*sourceLimiter
+}
+
+// sourceLimiter limits the token reviews of a single source.
+type sourceLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type serviceAccountCacheEntry struct {
+	namespace string
+	name      string
+	// err is set if the token was rejected.
+	err     error
+	expires time.Time
+}
+
+func NewServiceAccountAuthenticator(client kubernetes.Interface, audiences []string) *ServiceAccountAuthenticator {
+	return &ServiceAccountAuthenticator{
+		client:    client,
+		audiences: audiences,
+		now:       time.Now,
+		newLimit: func() *rate.Limiter {
+			return rate.NewLimiter(serviceAccountReviewRate, serviceAccountReviewBurst)
+		},
+		cache:    map[string]serviceAccountCacheEntry{},
+		limiters: map[string]*sourceLimiter{},
+	}
+}
+
+// IsServiceAccountToken returns true if the token has the format of a JWT, which is never the case for issued tokens.
+func IsServiceAccountToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Authenticate returns the namespace and name of the service account the token belongs to. Reviews are cached for a
+// short time to avoid a TokenReview for every request of a git operation. Reviews of tokens which are not cached are
+// rate limited per source, for example the address of the client, to protect the API server.
+func (s *ServiceAccountAuthenticator) Authenticate(ctx context.Context, token, source string) (string, string, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := s.now()
+
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	if ok && now.Before(entry.expires) {
+		s.mu.Unlock()
+		return entry.namespace, entry.name, entry.err
+	}
+	delete(s.cache, key)
+	allowed := s.allowReview(source, now)
+	s.mu.Unlock()
+	if !allowed {
+		return "", "", ErrTooManyTokenReviews
+	}
+
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: s.audiences,
+		},
+	}
+	result, err := s.client.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrTokenReviewFailed, err)
+	}
+	if !result.Status.Authenticated {
+		err := fmt.Errorf("token is not authenticated: %s", result.Status.Error)
+		s.store(key, serviceAccountCacheEntry{err: err, expires: now.Add(serviceAccountNegativeCacheTTL)})
+		return "", "", err
+	}
+	namespace, name, err := parseServiceAccountUsername(result.Status.User.Username)
+	if err != nil {
+		s.store(key, serviceAccountCacheEntry{err: err, expires: now.Add(serviceAccountNegativeCacheTTL)})
+		return "", "", err
+	}
+	s.store(key, serviceAccountCacheEntry{namespace: namespace, name: name, expires: now.Add(serviceAccountCacheTTL)})
+	return namespace, name, nil
+}
+
+// allowReview returns true if the source has not exceeded its rate of reviews, the caller has to hold the lock.
+func (s *ServiceAccountAuthenticator) allowReview(source string, now time.Time) bool {
+	l, ok := s.limiters[source]
+	if !ok {
+		// Limiters of sources which have not been seen for a while are removed, they would have refilled anyway
+		for k, other := range s.limiters {
+			if now.Sub(other.lastSeen) > serviceAccountLimiterTTL {
+				delete(s.limiters, k)
+			}
+		}
+		l = &sourceLimiter{limiter: s.newLimit()}
+		s.limiters[source] = l
+	}
+	l.lastSeen = now
+	return l.limiter.AllowN(now, 1)
+}
+
+func (s *ServiceAccountAuthenticator) store(key string, entry serviceAccountCacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Expired entries are removed to keep the cache from growing with tokens which are never used again
+	now := s.now()
+	for k, e := range s.cache {
+		if !now.Before(e.expires) {
+			delete(s.cache, k)
+		}
+	}
+	s.cache[key] = entry
+}
+
+// parseServiceAccountUsername parses usernames in the format system:serviceaccount:<namespace>:<name>.
+func parseServiceAccountUsername(username string) (string, string, error) {
+	comps := strings.Split(strings.TrimPrefix(username, serviceAccountPrefix), ":")
+	if !strings.HasPrefix(username, serviceAccountPrefix) || len(comps) != 2 || comps[0] == "" || comps[1] == "" {
+		return "", "", fmt.Errorf("user %s is not a service account", username)
+	}
+	return comps[0], comps[1], nil
+}
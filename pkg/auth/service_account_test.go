@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func newFakeTokenReviewClient(users map[string]string, reviews *int) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		*reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		username, ok := users[review.Spec.Token]
+		review.Status = authenticationv1.TokenReviewStatus{
+			Authenticated: ok,
+			User:          authenticationv1.UserInfo{Username: username},
+		}
+		if !ok {
+			review.Status.Error = "invalid token"
+		}
+		return true, review, nil
+	})
+	return client
+}
+
+func TestServiceAccountAuthenticator(t *testing.T) {
+	reviews := 0
+	client := newFakeTokenReviewClient(map[string]string{
+		"a.b.c": "system:serviceaccount:flux-system:source-controller",
+		"d.e.f": "admin",
+	}, &reviews)
+	authn := NewServiceAccountAuthenticator(client, nil)
+	now := time.Now()
+	authn.now = func() time.Time { return now }
+
+	namespace, name, err := authn.Authenticate(context.TODO(), "a.b.c", "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, "flux-system", namespace)
+	require.Equal(t, "source-controller", name)
+	require.Equal(t, 1, reviews)
+
+	// Reviews are cached until they expire
+	_, _, err = authn.Authenticate(context.TODO(), "a.b.c", "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, 1, reviews)
+	now = now.Add(2 * serviceAccountCacheTTL)
+	_, _, err = authn.Authenticate(context.TODO(), "a.b.c", "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, 2, reviews)
+
+	_, _, err = authn.Authenticate(context.TODO(), "d.e.f", "10.0.0.1")
+	require.EqualError(t, err, "user admin is not a service account")
+	_, _, err = authn.Authenticate(context.TODO(), "g.h.i", "10.0.0.1")
+	require.EqualError(t, err, "token is not authenticated: invalid token")
+	require.Equal(t, 4, reviews)
+
+	// Rejected tokens are cached for a shorter time
+	_, _, err = authn.Authenticate(context.TODO(), "g.h.i", "10.0.0.1")
+	require.EqualError(t, err, "token is not authenticated: invalid token")
+	require.Equal(t, 4, reviews)
+	now = now.Add(2 * serviceAccountNegativeCacheTTL)
+	_, _, err = authn.Authenticate(context.TODO(), "g.h.i", "10.0.0.1")
+	require.Error(t, err)
+	require.Equal(t, 5, reviews)
+
+	// Reviews are rate limited per source while cached tokens are still accepted
+	authn.newLimit = func() *rate.Limiter { return rate.NewLimiter(0, 1) }
+	authn.limiters = map[string]*sourceLimiter{}
+	_, _, err = authn.Authenticate(context.TODO(), "j.k.l", "10.0.0.2")
+	require.EqualError(t, err, "token is not authenticated: invalid token")
+	_, _, err = authn.Authenticate(context.TODO(), "m.n.o", "10.0.0.2")
+	require.ErrorIs(t, err, ErrTooManyTokenReviews)
+	require.Equal(t, 6, reviews)
+	_, _, err = authn.Authenticate(context.TODO(), "a.b.c", "10.0.0.2")
+	require.NoError(t, err)
+	_, _, err = authn.Authenticate(context.TODO(), "m.n.o", "10.0.0.3")
+	require.EqualError(t, err, "token is not authenticated: invalid token")
+	require.Equal(t, 7, reviews)
+
+	// Errors of the TokenReview API are not cached and are distinguished from rejected tokens
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	_, _, err = authn.Authenticate(context.TODO(), "p.q.r", "10.0.0.4")
+	require.ErrorIs(t, err, ErrTokenReviewFailed)
+
+	require.True(t, IsServiceAccountToken("a.b.c"))
+	token, err := randomSecureToken()
+	require.NoError(t, err)
+	require.False(t, IsServiceAccountToken(token))
+}
+
+func TestGetGrantByServiceAccount(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "dev.azure.com",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Project: "proj",
+						Name:    "repo",
+						Namespaces: []*config.Namespace{
+							{Name: "flux-system", ServiceAccounts: []string{"source-controller"}},
+							{Name: "default"},
+						},
+					},
+				},
+				Scopes: []*config.Scope{
+					{
+						Project:    "proj",
+						Namespaces: []*config.Namespace{{Name: "flux-system", ServiceAccounts: []string{"*"}}},
+						Access:     config.ReadAccessLevel,
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	repo, err := authz.GetEndpointById("dev.azure.com-org-proj-repo")
+	require.NoError(t, err)
+	scope, err := authz.GetEndpointById("dev.azure.com-org-proj-*")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		namespace      string
+		serviceAccount string
+		path           string
+		token          string
+	}{
+		{
+			name:           "repository is preferred over scope",
+			namespace:      "flux-system",
+			serviceAccount: "source-controller",
+			path:           "/org/proj/_git/repo",
+			token:          repo.Grants[0].Token,
+		},
+		{
+			name:           "any service account in scope",
+			namespace:      "flux-system",
+			serviceAccount: "other",
+			path:           "/org/proj/_git/repo",
+			token:          scope.Grants[0].Token,
+		},
+		{
+			name:           "other repository in scope",
+			namespace:      "flux-system",
+			serviceAccount: "source-controller",
+			path:           "/org/proj/_git/other",
+			token:          scope.Grants[0].Token,
+		},
+		{
+			name:           "namespace without service accounts",
+			namespace:      "default",
+			serviceAccount: "default",
+			path:           "/org/proj/_git/repo",
+		},
+		{
+			name:           "other project",
+			namespace:      "flux-system",
+			serviceAccount: "source-controller",
+			path:           "/org/other/_git/repo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := authz.GetGrantByServiceAccount(tt.namespace, tt.serviceAccount, tt.path)
+			if tt.token == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.token, g.Token)
+		})
+	}
+	require.True(t, repo.Grants[0].UsesServiceAccounts())
+	require.False(t, repo.Grants[1].UsesServiceAccounts())
+	require.True(t, authz.UsesServiceAccounts())
+
+	cfg.Organizations[0].Repositories[0].Namespaces = []*config.Namespace{{Name: "default"}}
+	cfg.Organizations[0].Scopes = nil
+	authz, err = NewAuthorizer(cfg)
+	require.NoError(t, err)
+	require.False(t, authz.UsesServiceAccounts())
+}
@@ -3,9 +3,14 @@ package auth
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"regexp"
 )
 
-const tokenLenght = 64
+const (
+	tokenLenght = 64
+	// anyPathSegment is used as the project or repository of scopes and matches any single path segment.
+	anyPathSegment = "*"
+)
 
 func randomSecureToken() (string, error) {
 	b := make([]byte, tokenLenght)
@@ -16,3 +21,11 @@ func randomSecureToken() (string, error) {
 	randStr := base64.URLEncoding.EncodeToString(b)
 	return randStr, nil
 }
+
+// pathSegment returns a regex which matches the value literally, or any single path segment for anyPathSegment.
+func pathSegment(value string) string {
+	if value == anyPathSegment {
+		return `[^/]+`
+	}
+	return regexp.QuoteMeta(value)
+}
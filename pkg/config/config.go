@@ -2,10 +2,13 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/afero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
@@ -15,22 +18,43 @@ const (
 type ProviderType string
 
 const (
-	AzureDevOpsProviderType = "azuredevops"
-	GitHubProviderType      = "github"
+	AzureDevOpsProviderType     = "azuredevops"
+	GitHubProviderType          = "github"
+	GitLabProviderType          = "gitlab"
+	BitbucketServerProviderType = "bitbucketserver"
+	BitbucketCloudProviderType  = "bitbucketcloud"
+	GiteaProviderType           = "gitea"
+	GenericProviderType         = "generic"
+	CodeCommitProviderType      = "codecommit"
 )
 
 type Configuration struct {
-	Organizations []*Organization `json:"organizations" validate:"required,dive"`
+	ServiceAccountAuth ServiceAccountAuth `json:"serviceAccountAuth,omitempty"`
+	Organizations      []*Organization    `json:"organizations" validate:"required,dive"`
+}
+
+// ServiceAccountAuth configures authentication with Kubernetes service account tokens, which are validated with the TokenReview API.
+type ServiceAccountAuth struct {
+	// Audiences defaults to the audiences of the API server when not set.
+	Audiences []string `json:"audiences,omitempty"`
 }
 
 type Organization struct {
-	Provider     ProviderType  `json:"provider" validate:"required,oneof='azuredevops' 'github'"`
-	AzureDevOps  AzureDevOps   `json:"azuredevops"`
-	GitHub       GitHub        `json:"github"`
-	Host         string        `json:"host,omitempty" validate:"required,hostname"`
-	Scheme       string        `json:"scheme,omitempty" validate:"required"`
-	Name         string        `json:"name" validate:"required"`
-	Repositories []*Repository `json:"repositories" validate:"required,dive"`
+	Provider        ProviderType    `json:"provider" validate:"required,oneof='azuredevops' 'github' 'gitlab' 'bitbucketserver' 'bitbucketcloud' 'gitea' 'generic' 'codecommit'"`
+	AzureDevOps     AzureDevOps     `json:"azuredevops"`
+	GitHub          GitHub          `json:"github"`
+	GitLab          GitLab          `json:"gitlab"`
+	BitbucketServer BitbucketServer `json:"bitbucketserver"`
+	BitbucketCloud  BitbucketCloud  `json:"bitbucketcloud"`
+	Gitea           Gitea           `json:"gitea"`
+	Generic         Generic         `json:"generic"`
+	CodeCommit      CodeCommit      `json:"codecommit"`
+	Host            string          `json:"host,omitempty" validate:"required,hostname"`
+	Scheme          string          `json:"scheme,omitempty" validate:"required"`
+	Name            string          `json:"name" validate:"required"`
+	Policy          Policy          `json:"policy,omitempty"`
+	Repositories    []*Repository   `json:"repositories" validate:"required_without=Scopes,dive"`
+	Scopes          []*Scope        `json:"scopes,omitempty" validate:"dive"`
 }
 
 func (o *Organization) GetSecretName(r *Repository) string {
@@ -41,27 +65,233 @@ func (o *Organization) GetSecretName(r *Repository) string {
 	comps := []string{}
 	comps = append(comps, o.Name)
 	if r.Project != "" {
-		comps = append(comps, r.Project)
+		// GitLab subgroups are separated with slashes which are not valid in secret names
+		comps = append(comps, strings.ReplaceAll(r.Project, "/", "-"))
 	}
 	comps = append(comps, r.Name)
 	return strings.Join(comps, "-")
 }
 
+// GetScopeSecretName returns the secret name of a scope, which is the organization and project joined by dashes.
+func (o *Organization) GetScopeSecretName(s *Scope) string {
+	if s.SecretNameOverride != "" {
+		return s.SecretNameOverride
+	}
+
+	comps := []string{o.Name}
+	if s.Project != "" && s.Project != AnyProject {
+		comps = append(comps, strings.ReplaceAll(s.Project, "/", "-"))
+	}
+	return strings.Join(comps, "-")
+}
+
 type AzureDevOps struct {
-	Pat string `json:"pat"`
+	Pat string `json:"pat" validate:"excluded_with=PatFrom"`
+	// PatFrom reads the PAT from a file, environment variable or secret instead of the configuration.
+	PatFrom *CredentialReference `json:"patFrom,omitempty"`
+	Entra   Entra                `json:"entra"`
+	// PathPrefix is the virtual directory of an Azure DevOps Server, for example "tfs".
+	PathPrefix string `json:"pathPrefix,omitempty"`
+}
+
+// Entra configures authentication to Azure DevOps with an Entra ID service principal instead of a PAT.
+// When workload identity is enabled the tenant ID, client ID and federated token file default to the
+// environment variables injected by the Azure Workload Identity webhook.
+type Entra struct {
+	TenantID     string `json:"tenantID"`
+	ClientID     string `json:"clientID"`
+	ClientSecret string `json:"clientSecret" validate:"excluded_with=ClientSecretFrom"`
+	// ClientSecretFrom reads the client secret from a file, environment variable or secret instead of the configuration.
+	ClientSecretFrom *CredentialReference `json:"clientSecretFrom,omitempty"`
+	WorkloadIdentity bool                 `json:"workloadIdentity"`
+	AuthorityHost    string               `json:"authorityHost,omitempty"`
 }
 
+// Enabled returns true if Entra ID authentication is configured.
+func (e *Entra) Enabled() bool {
+	return e.TenantID != "" || e.ClientID != "" || e.ClientSecret != "" || e.ClientSecretFrom != nil || e.WorkloadIdentity
+}
+
+// GitHub authenticates either as a GitHub App or with a static personal access token. The username is only
+// required when the token belongs to a machine user which should authenticate with basic authentication.
 type GitHub struct {
-	AppID          int64  `json:"appID"`
-	InstallationID int64  `json:"installationID"`
-	PrivateKey     string `json:"privateKey"`
+	Pat string `json:"pat,omitempty" validate:"excluded_with=PatFrom"`
+	// PatFrom reads the personal access token from a file, environment variable or secret instead of the configuration.
+	PatFrom  *CredentialReference `json:"patFrom,omitempty"`
+	Username string               `json:"username,omitempty"`
+
+	AppID int64 `json:"appID"`
+	// InstallationID is discovered through the GitHub Apps API when not set.
+	InstallationID int64  `json:"installationID,omitempty"`
+	PrivateKey     string `json:"privateKey" validate:"excluded_with=PrivateKeyFrom"`
+	// PrivateKeyFrom reads the private key from a file, environment variable or secret instead of the configuration,
+	// the key may be either PEM or base64 encoded.
+	PrivateKeyFrom *CredentialReference `json:"privateKeyFrom,omitempty"`
+	// RepositoryScoped restricts each installation token to a single repository, optionally
+	// with reduced permissions in the format {"contents": "read"}.
+	RepositoryScoped bool              `json:"repositoryScoped,omitempty"`
+	Permissions      map[string]string `json:"permissions,omitempty"`
+}
+
+type GitLab struct {
+	Token string `json:"token" validate:"excluded_with=TokenFrom"`
+	// TokenFrom reads the token from a file, environment variable or secret instead of the configuration.
+	TokenFrom *CredentialReference `json:"tokenFrom,omitempty"`
+}
+
+type BitbucketServer struct {
+	Token string `json:"token" validate:"excluded_with=TokenFrom"`
+	// TokenFrom reads the token from a file, environment variable or secret instead of the configuration.
+	TokenFrom *CredentialReference `json:"tokenFrom,omitempty"`
+}
+
+type BitbucketCloud struct {
+	Token string `json:"token" validate:"excluded_with=TokenFrom"`
+	// TokenFrom reads the token from a file, environment variable or secret instead of the configuration.
+	TokenFrom *CredentialReference `json:"tokenFrom,omitempty"`
+}
+
+type Gitea struct {
+	Token string `json:"token" validate:"excluded_with=TokenFrom"`
+	// TokenFrom reads the token from a file, environment variable or secret instead of the configuration.
+	TokenFrom *CredentialReference `json:"tokenFrom,omitempty"`
+}
+
+type GenericAuthType string
+
+const (
+	GenericBasicAuthType  = "basic"
+	GenericBearerAuthType = "bearer"
+	GenericHeaderAuthType = "header"
+)
+
+// GenericProjectPlaceholder is replaced with the project of the repository in the path templates of the generic provider.
+const GenericProjectPlaceholder = "{project}"
+
+// Generic describes a Git server through path templates. The templates may contain the placeholders
+// {organization}, {project} and {repository} which are replaced with the values of each repository.
+type Generic struct {
+	GitPaths []string    `json:"gitPaths"`
+	API      GenericAPI  `json:"api"`
+	Auth     GenericAuth `json:"auth"`
+}
+
+type GenericAPI struct {
+	Paths []string `json:"paths"`
+	// Prefix identifies API requests which should be routed to the API host.
+	Prefix      string `json:"prefix"`
+	Host        string `json:"host" validate:"omitempty,hostname"`
+	StripPrefix bool   `json:"stripPrefix"`
 }
 
+type GenericAuth struct {
+	Type     GenericAuthType `json:"type" validate:"omitempty,oneof='basic' 'bearer' 'header'"`
+	Username string          `json:"username"`
+	Password string          `json:"password" validate:"excluded_with=PasswordFrom"`
+	// PasswordFrom reads the password from a file, environment variable or secret instead of the configuration.
+	PasswordFrom *CredentialReference `json:"passwordFrom,omitempty"`
+	Token        string               `json:"token" validate:"excluded_with=TokenFrom"`
+	// TokenFrom reads the token from a file, environment variable or secret instead of the configuration.
+	TokenFrom *CredentialReference `json:"tokenFrom,omitempty"`
+	Header    string               `json:"header"`
+}
+
+// CodeCommit credentials are read from the default AWS credential chain.
+type CodeCommit struct {
+	// Region is parsed from the host when not set.
+	Region string `json:"region"`
+}
+
+type AccessLevel string
+
+const (
+	ReadAccessLevel  = "read"
+	WriteAccessLevel = "write"
+)
+
 type Repository struct {
-	Project            string   `json:"project"`
-	Name               string   `json:"name" validate:"required"`
-	Namespaces         []string `json:"namespaces" validate:"required"`
-	SecretNameOverride string   `json:"secretNameOverride,omitempty"`
+	Project    string       `json:"project"`
+	Name       string       `json:"name" validate:"required"`
+	Namespaces []*Namespace `json:"namespaces" validate:"required_without=NamespaceSelector,dive,required"`
+	// NamespaceSelector gives all namespaces with matching labels access with the settings of the repository, in addition to the namespaces.
+	NamespaceSelector  *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	SecretNameOverride string                `json:"secretNameOverride,omitempty"`
+	// Access defaults to write when not set.
+	Access AccessLevel `json:"access,omitempty" validate:"omitempty,oneof='read' 'write'"`
+	// AllowedRefs limits pushes to refs matching one of the patterns, where * matches any characters.
+	AllowedRefs []string `json:"allowedRefs,omitempty"`
+	// Policy rules of the repository are evaluated before the rules of the organization.
+	Policy Policy `json:"policy,omitempty"`
+}
+
+// AnyProject is used as the project of a scope to give access to the repositories in all projects.
+const AnyProject = "*"
+
+// Scope gives namespaces access to all repositories in the organization, or in a single project when the project is set.
+type Scope struct {
+	Project            string                `json:"project"`
+	Namespaces         []*Namespace          `json:"namespaces" validate:"required_without=NamespaceSelector,dive,required"`
+	NamespaceSelector  *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	SecretNameOverride string                `json:"secretNameOverride,omitempty"`
+	// Access defaults to write when not set.
+	Access      AccessLevel `json:"access,omitempty" validate:"omitempty,oneof='read' 'write'"`
+	AllowedRefs []string    `json:"allowedRefs,omitempty"`
+	Policy      Policy      `json:"policy,omitempty"`
+}
+
+type PolicyAction string
+
+const (
+	AllowPolicyAction = "allow"
+	DenyPolicyAction  = "deny"
+)
+
+// Policy contains rules for API requests which are evaluated in order, the first rule matching a request decides if it is permitted.
+type Policy struct {
+	// DisableDefaults removes the default rules of the provider.
+	DisableDefaults bool         `json:"disableDefaults,omitempty"`
+	Rules           []PolicyRule `json:"rules,omitempty" validate:"dive"`
+}
+
+type PolicyRule struct {
+	Name string `json:"name" validate:"required"`
+	// Action defaults to allow when not set.
+	Action PolicyAction `json:"action,omitempty" validate:"omitempty,oneof='allow' 'deny'"`
+	// Methods matches all methods when not set.
+	Methods []string `json:"methods,omitempty"`
+	// Path matches the path and its sub paths, and may contain the placeholders {organization}, {project} and {repository}.
+	Path string `json:"path" validate:"required"`
+}
+
+// Namespace is a namespace which is given a token for a repository. It can be configured either as the name of the
+// namespace or as an object which overrides the settings of the repository for the namespace.
+type Namespace struct {
+	Name string `json:"name" validate:"required"`
+	// Access defaults to the access of the repository when not set.
+	Access AccessLevel `json:"access,omitempty" validate:"omitempty,oneof='read' 'write'"`
+	// AllowedRoutes limits the API requests of the namespace to the given routes in the format "[METHOD,...] <path>".
+	// Git requests are not affected by the routes.
+	AllowedRoutes []string `json:"allowedRoutes,omitempty"`
+	// AllowedRefs defaults to the allowed refs of the repository when not set.
+	AllowedRefs []string `json:"allowedRefs,omitempty"`
+	// ServiceAccounts which can authenticate with their service account token, where * permits all service accounts in the
+	// namespace. No secret is written to the namespace when service accounts are set.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+}
+
+func (n *Namespace) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*n = Namespace{Name: name}
+		return nil
+	}
+	type namespace Namespace
+	ns := namespace{}
+	if err := json.Unmarshal(b, &ns); err != nil {
+		return err
+	}
+	*n = Namespace(ns)
+	return nil
 }
 
 func setConfigurationDefaults(cfg *Configuration) *Configuration {
@@ -69,6 +299,26 @@ func setConfigurationDefaults(cfg *Configuration) *Configuration {
 		if o.Scheme == "" {
 			cfg.Organizations[i].Scheme = defaultScheme
 		}
+		for j, r := range o.Repositories {
+			if r.Access == "" {
+				cfg.Organizations[i].Repositories[j].Access = WriteAccessLevel
+			}
+			for k, ns := range r.Namespaces {
+				if ns != nil && ns.Access == "" {
+					cfg.Organizations[i].Repositories[j].Namespaces[k].Access = cfg.Organizations[i].Repositories[j].Access
+				}
+			}
+		}
+		for j, s := range o.Scopes {
+			if s.Access == "" {
+				cfg.Organizations[i].Scopes[j].Access = WriteAccessLevel
+			}
+			for k, ns := range s.Namespaces {
+				if ns != nil && ns.Access == "" {
+					cfg.Organizations[i].Scopes[j].Namespaces[k].Access = cfg.Organizations[i].Scopes[j].Access
+				}
+			}
+		}
 	}
 	return cfg
 }
@@ -79,18 +329,88 @@ func LoadConfiguration(fs afero.Fs, path string) (*Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
+	return parseConfiguration(b)
+}
 
+func parseConfiguration(b []byte) (*Configuration, error) {
 	cfg := &Configuration{}
-	err = json.Unmarshal(b, &cfg)
+	err := json.Unmarshal(b, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	cfg = setConfigurationDefaults(cfg)
+	return ValidateConfiguration(cfg)
+}
 
+// ValidateConfiguration sets the defaults of the configuration and validates it.
+func ValidateConfiguration(cfg *Configuration) (*Configuration, error) {
+	cfg = setConfigurationDefaults(cfg)
 	validate := validator.New()
-	err = validate.Struct(cfg)
+	err := validate.Struct(cfg)
 	if err != nil {
 		return nil, err
 	}
+	for _, o := range cfg.Organizations {
+		if err := validateEntra(o); err != nil {
+			return nil, err
+		}
+		if err := validateGeneric(o); err != nil {
+			return nil, err
+		}
+	}
 	return cfg, nil
 }
+
+// ValidateRepository sets the defaults of a repository which is added to the organization and validates it in the same
+// way as the repositories of the configuration file, without validating the rest of the organization again.
+func ValidateRepository(o *Organization, r *Repository) error {
+	org := *o
+	org.Repositories = []*Repository{r}
+	org.Scopes = nil
+	setConfigurationDefaults(&Configuration{Organizations: []*Organization{&org}})
+	validate := validator.New()
+	if err := validate.Struct(r); err != nil {
+		return err
+	}
+	return validateGeneric(&org)
+}
+
+// validateEntra rejects partial Entra ID configurations, which would otherwise fail when the provider is created or
+// silently fall back to the PAT. The tenant and client IDs are read from the environment when using workload identity.
+func validateEntra(o *Organization) error {
+	e := o.AzureDevOps.Entra
+	if o.Provider != AzureDevOpsProviderType || !e.Enabled() || e.WorkloadIdentity {
+		return nil
+	}
+	if e.TenantID == "" || e.ClientID == "" {
+		return errors.New("tenant ID and client ID are required for Entra ID authentication")
+	}
+	if e.ClientSecret == "" && e.ClientSecretFrom == nil {
+		return errors.New("either a client secret or workload identity is required for Entra ID authentication")
+	}
+	return nil
+}
+
+// validateGeneric checks that every repository and scope has a project when the path templates of a generic organization
+// contain the project placeholder, as the paths would otherwise never match any request.
+func validateGeneric(o *Organization) error {
+	if o.Provider != GenericProviderType {
+		return nil
+	}
+	templates := append(append([]string{}, o.Generic.GitPaths...), o.Generic.API.Paths...)
+	for _, tpl := range templates {
+		if !strings.Contains(tpl, GenericProjectPlaceholder) {
+			continue
+		}
+		for _, r := range o.Repositories {
+			if r.Project == "" {
+				return fmt.Errorf("repository %s requires a project as the generic path %s contains %s", r.Name, tpl, GenericProjectPlaceholder)
+			}
+		}
+		for _, s := range o.Scopes {
+			if s.Project == "" {
+				return fmt.Errorf("scope requires a project as the generic path %s contains %s", tpl, GenericProjectPlaceholder)
+			}
+		}
+	}
+	return nil
+}
@@ -78,6 +78,151 @@ func TestValidAzureDevOps(t *testing.T) {
 	require.NotEmpty(t, cfg.Organizations[0].Repositories)
 	require.Equal(t, "gitops-deployment", cfg.Organizations[0].Repositories[0].Name)
 	require.Equal(t, "Lab", cfg.Organizations[0].Repositories[0].Project)
+	require.Equal(t, WriteAccessLevel, string(cfg.Organizations[0].Repositories[0].Access))
+	require.Equal(t, "foo", cfg.Organizations[0].Repositories[0].Namespaces[0].Name)
+	require.Equal(t, WriteAccessLevel, string(cfg.Organizations[0].Repositories[0].Namespaces[0].Access))
+}
+
+const namespaceOverrides = `
+{
+	"organizations": [
+		{
+			"provider": "azuredevops",
+			"azuredevops": {
+				"pat": "foobar"
+			},
+			"host": "dev.azure.com",
+			"name": "xenitab",
+			"repositories": [
+				{
+					"project": "Lab",
+					"name": "gitops-deployment",
+					"access": "read",
+					"namespaces": [
+						"foo",
+						{
+							"name": "bar",
+							"access": "write",
+							"allowedRoutes": ["GET /xenitab/Lab/_apis/git/repositories/gitops-deployment/pullrequests"]
+						}
+					]
+				}
+			]
+		}
+	]
+}
+`
+
+const scopes = `
+{
+	"organizations": [
+		{
+			"provider": "azuredevops",
+			"azuredevops": {
+				"pat": "foobar"
+			},
+			"host": "dev.azure.com",
+			"name": "xenitab",
+			"scopes": [
+				{
+					"project": "Lab",
+					"namespaces": ["foo"]
+				},
+				{
+					"project": "*",
+					"access": "read",
+					"namespaces": ["bar"]
+				}
+			]
+		}
+	]
+}
+`
+
+func TestScopes(t *testing.T) {
+	fs, path, err := fsWithContent(scopes)
+	require.NoError(t, err)
+	cfg, err := LoadConfiguration(fs, path)
+	require.NoError(t, err)
+
+	o := cfg.Organizations[0]
+	require.Empty(t, o.Repositories)
+	require.Len(t, o.Scopes, 2)
+	require.Equal(t, WriteAccessLevel, string(o.Scopes[0].Access))
+	require.Equal(t, WriteAccessLevel, string(o.Scopes[0].Namespaces[0].Access))
+	require.Equal(t, "xenitab-Lab", o.GetScopeSecretName(o.Scopes[0]))
+	require.Equal(t, ReadAccessLevel, string(o.Scopes[1].Namespaces[0].Access))
+	require.Equal(t, "xenitab", o.GetScopeSecretName(o.Scopes[1]))
+}
+
+func TestNamespaceOverrides(t *testing.T) {
+	fs, path, err := fsWithContent(namespaceOverrides)
+	require.NoError(t, err)
+	cfg, err := LoadConfiguration(fs, path)
+	require.NoError(t, err)
+
+	namespaces := cfg.Organizations[0].Repositories[0].Namespaces
+	require.Len(t, namespaces, 2)
+	require.Equal(t, "foo", namespaces[0].Name)
+	require.Equal(t, ReadAccessLevel, string(namespaces[0].Access))
+	require.Empty(t, namespaces[0].AllowedRoutes)
+	require.Equal(t, "bar", namespaces[1].Name)
+	require.Equal(t, WriteAccessLevel, string(namespaces[1].Access))
+	require.Equal(t, []string{"GET /xenitab/Lab/_apis/git/repositories/gitops-deployment/pullrequests"}, namespaces[1].AllowedRoutes)
+}
+
+func TestNullNamespace(t *testing.T) {
+	for _, content := range []string{
+		`{"organizations": [{"provider": "gitlab", "host": "gitlab.com", "name": "org", "repositories": [{"name": "repo", "namespaces": [null]}]}]}`,
+		`{"organizations": [{"provider": "gitlab", "host": "gitlab.com", "name": "org", "scopes": [{"namespaces": ["foo", null]}]}]}`,
+		`{"organizations": [{"provider": "gitlab", "host": "gitlab.com", "name": "org", "repositories": [{"name": "repo", "namespaces": [{"access": "read"}]}]}]}`,
+	} {
+		fs, path, err := fsWithContent(content)
+		require.NoError(t, err)
+		_, err = LoadConfiguration(fs, path)
+		require.Error(t, err)
+	}
+}
+
+const namespaceSelector = `
+{
+	"organizations": [
+		{
+			"provider": "azuredevops",
+			"azuredevops": {
+				"pat": "foobar"
+			},
+			"host": "dev.azure.com",
+			"name": "xenitab",
+			"repositories": [
+				{
+					"project": "Lab",
+					"name": "gitops-deployment",
+					"namespaceSelector": {
+						"matchLabels": {
+							"tenant": "true"
+						}
+					}
+				}
+			]
+		}
+	]
+}
+`
+
+func TestNamespaceSelector(t *testing.T) {
+	fs, path, err := fsWithContent(namespaceSelector)
+	require.NoError(t, err)
+	cfg, err := LoadConfiguration(fs, path)
+	require.NoError(t, err)
+
+	repo := cfg.Organizations[0].Repositories[0]
+	require.Empty(t, repo.Namespaces)
+	require.Equal(t, map[string]string{"tenant": "true"}, repo.NamespaceSelector.MatchLabels)
+
+	repo.NamespaceSelector = nil
+	_, err = ValidateConfiguration(cfg)
+	require.Error(t, err)
 }
 
 const validGitHub = `
@@ -123,3 +268,107 @@ func TestValidGitHub(t *testing.T) {
 	require.Equal(t, "gitops-deployment", cfg.Organizations[0].Repositories[0].Name)
 	require.Equal(t, "", cfg.Organizations[0].Repositories[0].Project)
 }
+
+const validGitLab = `
+{
+	"organizations": [
+		{
+      "provider": "gitlab",
+			"gitlab": {
+        "token": "foobar"
+      },
+			"host": "gitlab.com",
+			"name": "xenitab",
+			"repositories": [
+				{
+					"project": "platform/gitops",
+					"name": "gitops-deployment",
+					"namespaces": ["foo"]
+				}
+			]
+		}
+	]
+}
+`
+
+func TestValidGitLab(t *testing.T) {
+	fs, path, err := fsWithContent(validGitLab)
+	require.NoError(t, err)
+	cfg, err := LoadConfiguration(fs, path)
+	require.NoError(t, err)
+
+	require.NotEmpty(t, cfg.Organizations)
+	require.Equal(t, "gitlab", string(cfg.Organizations[0].Provider))
+	require.Equal(t, "foobar", cfg.Organizations[0].GitLab.Token)
+	require.Equal(t, "gitlab.com", cfg.Organizations[0].Host)
+	require.Equal(t, "platform/gitops", cfg.Organizations[0].Repositories[0].Project)
+	require.Equal(t, "xenitab-platform-gitops-gitops-deployment", cfg.Organizations[0].GetSecretName(cfg.Organizations[0].Repositories[0]))
+}
+
+func TestGenericProjectPlaceholder(t *testing.T) {
+	generic := `"provider": "generic", "generic": {"gitPaths": ["/{organization}/{project}/{repository}"], "auth": {"type": "bearer", "token": "foo"}}`
+	for _, tt := range []struct {
+		content string
+		valid   bool
+	}{
+		{
+			content: `{"organizations": [{` + generic + `, "host": "git.example.com", "name": "org", "repositories": [{"project": "foo", "name": "repo", "namespaces": ["foo"]}]}]}`,
+			valid:   true,
+		},
+		{
+			content: `{"organizations": [{` + generic + `, "host": "git.example.com", "name": "org", "repositories": [{"name": "repo", "namespaces": ["foo"]}]}]}`,
+			valid:   false,
+		},
+		{
+			content: `{"organizations": [{` + generic + `, "host": "git.example.com", "name": "org", "scopes": [{"namespaces": ["foo"]}]}]}`,
+			valid:   false,
+		},
+	} {
+		fs, path, err := fsWithContent(tt.content)
+		require.NoError(t, err)
+		_, err = LoadConfiguration(fs, path)
+		if tt.valid {
+			require.NoError(t, err)
+			continue
+		}
+		require.Error(t, err)
+	}
+}
+
+func TestPartialEntra(t *testing.T) {
+	for _, tt := range []struct {
+		entra string
+		valid bool
+	}{
+		{
+			entra: `{"tenantID": "tenant", "clientID": "client", "clientSecret": "secret"}`,
+			valid: true,
+		},
+		{
+			entra: `{"workloadIdentity": true}`,
+			valid: true,
+		},
+		{
+			entra: `{"tenantID": "tenant", "clientID": "client"}`,
+			valid: false,
+		},
+		{
+			entra: `{"tenantID": "tenant"}`,
+			valid: false,
+		},
+		{
+			entra: `{"clientID": "client", "clientSecret": "secret"}`,
+			valid: false,
+		},
+	} {
+		content := `{"organizations": [{"provider": "azuredevops", "azuredevops": {"pat": "foo", "entra": ` + tt.entra + `}, "host": "dev.azure.com", "name": "org", "repositories": [{"project": "proj", "name": "repo", "namespaces": ["foo"]}]}]}`
+		fs, path, err := fsWithContent(content)
+		require.NoError(t, err)
+		_, err = LoadConfiguration(fs, path)
+		if tt.valid {
+			require.NoError(t, err)
+			continue
+		}
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/afero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CredentialReference references a credential which is kept outside of the configuration, exactly one of the sources has to be set.
+type CredentialReference struct {
+	// File is read again while the configuration is watched, which allows mounted secrets to be rotated.
+	File   string              `json:"file,omitempty" validate:"required_without_all=Env Secret,excluded_with=Env Secret"`
+	Env    string              `json:"env,omitempty" validate:"excluded_with=File Secret"`
+	Secret *SecretKeyReference `json:"secret,omitempty"`
+}
+
+// SecretKeyReference references a key in a Kubernetes secret.
+type SecretKeyReference struct {
+	Namespace string `json:"namespace" validate:"required"`
+	Name      string `json:"name" validate:"required"`
+	Key       string `json:"key" validate:"required"`
+}
+
+// credential is a credential of an organization which can be read from a credential reference.
+type credential struct {
+	name  string
+	ref   **CredentialReference
+	value *string
+}
+
+// credentials returns the credentials of the organization which can be referenced.
+func (o *Organization) credentials() []credential {
+	return []credential{
+		{name: "PAT", ref: &o.AzureDevOps.PatFrom, value: &o.AzureDevOps.Pat},
+		{name: "Entra client secret", ref: &o.AzureDevOps.Entra.ClientSecretFrom, value: &o.AzureDevOps.Entra.ClientSecret},
+		{name: "GitHub PAT", ref: &o.GitHub.PatFrom, value: &o.GitHub.Pat},
+		{name: "private key", ref: &o.GitHub.PrivateKeyFrom, value: &o.GitHub.PrivateKey},
+		{name: "GitLab token", ref: &o.GitLab.TokenFrom, value: &o.GitLab.Token},
+		{name: "Bitbucket Server token", ref: &o.BitbucketServer.TokenFrom, value: &o.BitbucketServer.Token},
+		{name: "Bitbucket Cloud token", ref: &o.BitbucketCloud.TokenFrom, value: &o.BitbucketCloud.Token},
+		{name: "Gitea token", ref: &o.Gitea.TokenFrom, value: &o.Gitea.Token},
+		{name: "generic password", ref: &o.Generic.Auth.PasswordFrom, value: &o.Generic.Auth.Password},
+		{name: "generic token", ref: &o.Generic.Auth.TokenFrom, value: &o.Generic.Auth.Token},
+	}
+}
+
+// ResolveCredentials replaces the credential references in the configuration with the credentials which they reference.
+// The client is only used to read secrets and may be nil when no secrets are referenced.
+func ResolveCredentials(ctx context.Context, fs afero.Fs, client kubernetes.Interface, cfg *Configuration) error {
+	for _, o := range cfg.Organizations {
+		for _, c := range o.credentials() {
+			if *c.ref == nil {
+				continue
+			}
+			value, err := resolveCredential(ctx, fs, client, *c.ref)
+			if err != nil {
+				return fmt.Errorf("could not resolve %s of organization %s: %w", c.name, o.Name, err)
+			}
+			*c.value = value
+			*c.ref = nil
+		}
+	}
+	return nil
+}
+
+// HasCredentialReferences returns true if any organization references credentials outside of the configuration.
+func (c *Configuration) HasCredentialReferences() bool {
+	for _, o := range c.Organizations {
+		if o.HasCredentialReferences() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCredentialReferences returns true if the organization references credentials outside of the configuration.
+func (o *Organization) HasCredentialReferences() bool {
+	for _, c := range o.credentials() {
+		if *c.ref != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveCredential(ctx context.Context, fs afero.Fs, client kubernetes.Interface, ref *CredentialReference) (string, error) {
+	switch {
+	case ref.File != "":
+		b, err := afero.ReadFile(fs, ref.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case ref.Env != "":
+		value, ok := os.LookupEnv(ref.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", ref.Env)
+		}
+		return strings.TrimSpace(value), nil
+	case ref.Secret != nil:
+		if client == nil {
+			return "", errors.New("secrets cannot be referenced without a Kubernetes client")
+		}
+		secret, err := client.CoreV1().Secrets(ref.Secret.Namespace).Get(ctx, ref.Secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		value, ok := secret.Data[ref.Secret.Key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found in secret %s/%s", ref.Secret.Key, ref.Secret.Namespace, ref.Secret.Name)
+		}
+		return strings.TrimSpace(string(value)), nil
+	default:
+		return "", errors.New("credential reference has no source")
+	}
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const credentialReferences = `
+{
+	"organizations": [
+		{
+			"provider": "azuredevops",
+			"azuredevops": {
+				"patFrom": {
+					"file": "/var/run/secrets/pat"
+				}
+			},
+			"host": "dev.azure.com",
+			"name": "file",
+			"repositories": [
+				{
+					"project": "Lab",
+					"name": "gitops-deployment",
+					"namespaces": ["foo"]
+				}
+			]
+		},
+		{
+			"provider": "azuredevops",
+			"azuredevops": {
+				"patFrom": {
+					"env": "GIT_AUTH_PROXY_TEST_PAT"
+				}
+			},
+			"host": "dev.azure.com",
+			"name": "env",
+			"repositories": [
+				{
+					"project": "Lab",
+					"name": "gitops-deployment",
+					"namespaces": ["foo"]
+				}
+			]
+		},
+		{
+			"provider": "github",
+			"github": {
+				"appID": 123,
+				"privateKeyFrom": {
+					"secret": {
+						"namespace": "git-auth-proxy",
+						"name": "github",
+						"key": "private-key"
+					}
+				}
+			},
+			"host": "github.com",
+			"name": "secret",
+			"repositories": [
+				{
+					"name": "gitops-deployment",
+					"namespaces": ["foo"]
+				}
+			]
+		},
+		{
+			"provider": "gitlab",
+			"gitlab": {
+				"tokenFrom": {
+					"env": "GIT_AUTH_PROXY_TEST_TOKEN"
+				}
+			},
+			"host": "gitlab.com",
+			"name": "token",
+			"repositories": [
+				{
+					"project": "group",
+					"name": "gitops-deployment",
+					"namespaces": ["foo"]
+				}
+			]
+		}
+	]
+}
+`
+
+func TestResolveCredentials(t *testing.T) {
+	fs, path, err := fsWithContent(credentialReferences)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, "/var/run/secrets/pat", []byte("file-pat\n"), 0o600))
+	t.Setenv("GIT_AUTH_PROXY_TEST_PAT", "env-pat")
+	t.Setenv("GIT_AUTH_PROXY_TEST_TOKEN", "env-token")
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "git-auth-proxy", Name: "github"},
+		Data:       map[string][]byte{"private-key": []byte("private-key")},
+	})
+
+	cfg, err := LoadConfiguration(fs, path)
+	require.NoError(t, err)
+	require.True(t, cfg.Organizations[0].HasCredentialReferences())
+	err = ResolveCredentials(context.TODO(), fs, client, cfg)
+	require.NoError(t, err)
+	require.Equal(t, "file-pat", cfg.Organizations[0].AzureDevOps.Pat)
+	require.Equal(t, "env-pat", cfg.Organizations[1].AzureDevOps.Pat)
+	require.Equal(t, "private-key", cfg.Organizations[2].GitHub.PrivateKey)
+	require.Equal(t, "env-token", cfg.Organizations[3].GitLab.Token)
+	for _, o := range cfg.Organizations {
+		require.False(t, o.HasCredentialReferences())
+	}
+	// The resolved configuration is still valid
+	_, err = ValidateConfiguration(cfg)
+	require.NoError(t, err)
+}
+
+func TestResolveAllCredentials(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	o := &Organization{Name: "org"}
+	require.False(t, o.HasCredentialReferences())
+	for i, c := range o.credentials() {
+		path := fmt.Sprintf("/var/run/secrets/%d", i)
+		require.NoError(t, afero.WriteFile(fs, path, []byte(c.name), 0o600))
+		*c.ref = &CredentialReference{File: path}
+	}
+	require.True(t, o.HasCredentialReferences())
+
+	err := ResolveCredentials(context.TODO(), fs, nil, &Configuration{Organizations: []*Organization{o}})
+	require.NoError(t, err)
+	require.False(t, o.HasCredentialReferences())
+	require.Equal(t, "PAT", o.AzureDevOps.Pat)
+	require.Equal(t, "Entra client secret", o.AzureDevOps.Entra.ClientSecret)
+	require.Equal(t, "GitHub PAT", o.GitHub.Pat)
+	require.Equal(t, "private key", o.GitHub.PrivateKey)
+	require.Equal(t, "GitLab token", o.GitLab.Token)
+	require.Equal(t, "Bitbucket Server token", o.BitbucketServer.Token)
+	require.Equal(t, "Bitbucket Cloud token", o.BitbucketCloud.Token)
+	require.Equal(t, "Gitea token", o.Gitea.Token)
+	require.Equal(t, "generic password", o.Generic.Auth.Password)
+	require.Equal(t, "generic token", o.Generic.Auth.Token)
+}
+
+func TestResolveCredentialsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		ref  *CredentialReference
+	}{
+		{
+			name: "missing file",
+			ref:  &CredentialReference{File: "/missing"},
+		},
+		{
+			name: "missing environment variable",
+			ref:  &CredentialReference{Env: "GIT_AUTH_PROXY_TEST_MISSING"},
+		},
+		{
+			name: "missing secret",
+			ref:  &CredentialReference{Secret: &SecretKeyReference{Namespace: "default", Name: "missing", Key: "pat"}},
+		},
+		{
+			name: "missing secret key",
+			ref:  &CredentialReference{Secret: &SecretKeyReference{Namespace: "default", Name: "pat", Key: "missing"}},
+		},
+	}
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pat"},
+		Data:       map[string][]byte{"pat": []byte("pat")},
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Configuration{Organizations: []*Organization{{AzureDevOps: AzureDevOps{PatFrom: tt.ref}}}}
+			err := ResolveCredentials(context.TODO(), afero.NewMemMapFs(), client, cfg)
+			require.Error(t, err)
+		})
+	}
+
+	cfg := &Configuration{Organizations: []*Organization{{AzureDevOps: AzureDevOps{PatFrom: tests[2].ref}}}}
+	err := ResolveCredentials(context.TODO(), afero.NewMemMapFs(), nil, cfg)
+	require.EqualError(t, err, "could not resolve PAT of organization : secrets cannot be referenced without a Kubernetes client")
+}
+
+func TestCredentialReferenceValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		ado   AzureDevOps
+		valid bool
+	}{
+		{
+			name:  "file",
+			ado:   AzureDevOps{PatFrom: &CredentialReference{File: "/pat"}},
+			valid: true,
+		},
+		{
+			name:  "inline and reference",
+			ado:   AzureDevOps{Pat: "pat", PatFrom: &CredentialReference{File: "/pat"}},
+			valid: false,
+		},
+		{
+			name:  "inline and referenced client secret",
+			ado:   AzureDevOps{Entra: Entra{ClientID: "client", ClientSecret: "secret", ClientSecretFrom: &CredentialReference{File: "/secret"}}},
+			valid: false,
+		},
+		{
+			name:  "no source",
+			ado:   AzureDevOps{PatFrom: &CredentialReference{}},
+			valid: false,
+		},
+		{
+			name:  "multiple sources",
+			ado:   AzureDevOps{PatFrom: &CredentialReference{File: "/pat", Env: "PAT"}},
+			valid: false,
+		},
+		{
+			name:  "secret without key",
+			ado:   AzureDevOps{PatFrom: &CredentialReference{Secret: &SecretKeyReference{Namespace: "default", Name: "pat"}}},
+			valid: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Configuration{
+				Organizations: []*Organization{
+					{
+						Provider:    AzureDevOpsProviderType,
+						AzureDevOps: tt.ado,
+						Host:        "dev.azure.com",
+						Name:        "org",
+						Scopes:      []*Scope{{Namespaces: []*Namespace{{Name: "foo"}}}},
+					},
+				},
+			}
+			_, err := ValidateConfiguration(cfg)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/afero"
+	"k8s.io/client-go/kubernetes"
+)
+
+var configReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "git_auth_proxy_config_reloads_total",
+	Help: "The number of configuration reloads by result.",
+}, []string{"result"})
+
+var configReloadFailing = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "git_auth_proxy_config_reload_failing",
+	Help: "Set to 1 while the latest configuration or credentials cannot be applied and the previous ones are used.",
+})
+
+// WatchConfiguration polls the configuration file at the given interval and calls reload when its content has changed,
+// or updateCredentials when only a credential which it references has changed so that the credentials can be replaced
+// without applying the whole configuration again. Polling is used as mounted secrets and config maps are updated by
+// replacing a symlink, which file system events do not reliably report. A configuration which cannot be loaded or
+// reloaded is retried at every interval until it is applied, as the failure may be transient, for example a referenced
+// secret which does not exist yet. The failure is only logged again when the content or error changes. Changes to the
+// file are ignored when reload is nil, in
+// which case only the credentials referenced when watching starts are watched. Watching is disabled when the interval is
+// zero or negative.
+func WatchConfiguration(
+	ctx context.Context,
+	fs afero.Fs,
+	client kubernetes.Interface,
+	path string,
+	interval time.Duration,
+	reload func(cfg *Configuration) error,
+	updateCredentials func(cfg *Configuration) error,
+) error {
+	if interval <= 0 {
+		return nil
+	}
+	log := logr.FromContextOrDiscard(ctx).WithName("config")
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return err
+	}
+	// The applied content and hash are only replaced when the change has been applied, so that failures are retried
+	_, hash, _ := resolveConfiguration(ctx, fs, client, b)
+	var failed []byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		newB := b
+		if reload != nil {
+			newB, err = afero.ReadFile(fs, path)
+			if err != nil {
+				log.Error(err, "could not read configuration")
+				continue
+			}
+		}
+		fileChanged := !bytes.Equal(b, newB)
+		cfg, newHash, err := resolveConfiguration(ctx, fs, client, newB)
+		if !fileChanged && err == nil && bytes.Equal(hash, newHash) {
+			continue
+		}
+		msg := "reloaded configuration"
+		if err == nil {
+			if fileChanged {
+				err = reload(cfg)
+			} else {
+				msg = "updated credentials"
+				err = updateCredentials(cfg)
+			}
+		}
+		if err != nil {
+			configReloadsTotal.WithLabelValues("failure").Inc()
+			configReloadFailing.Set(1)
+			attempt := sha256.Sum256(append(append(slices.Clone(newB), newHash...), err.Error()...))
+			if !bytes.Equal(failed, attempt[:]) {
+				log.Error(err, "could not reload configuration, retrying at the next interval")
+				failed = attempt[:]
+			}
+			continue
+		}
+		b = newB
+		hash = newHash
+		failed = nil
+		configReloadsTotal.WithLabelValues("success").Inc()
+		configReloadFailing.Set(0)
+		log.Info(msg)
+	}
+}
+
+// resolveConfiguration parses the configuration and resolves its credential references. The hash covers the resolved
+// credentials so that rotated credentials are detected, it is nil when the configuration cannot be resolved.
+func resolveConfiguration(ctx context.Context, fs afero.Fs, client kubernetes.Interface, b []byte) (*Configuration, []byte, error) {
+	cfg, err := parseConfiguration(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ResolveCredentials(ctx, fs, client, cfg); err != nil {
+		return nil, nil, err
+	}
+	resolved, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.Sum256(resolved)
+	return cfg, h[:], nil
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWatchConfiguration(t *testing.T) {
+	fs, path, err := fsWithContent(validAzureDevOps)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	reloaded := make(chan *Configuration)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- WatchConfiguration(ctx, fs, nil, path, 10*time.Millisecond, func(cfg *Configuration) error {
+			reloaded <- cfg
+			return nil
+		}, nil)
+	}()
+
+	success := testutil.ToFloat64(configReloadsTotal.WithLabelValues("success"))
+	failure := testutil.ToFloat64(configReloadsTotal.WithLabelValues("failure"))
+
+	// Unchanged content does not reload the configuration
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, afero.WriteFile(fs, path, []byte(validGitLab), 0o600))
+	cfg := <-reloaded
+	require.EqualValues(t, GitLabProviderType, cfg.Organizations[0].Provider)
+	require.InEpsilon(t, success+1, testutil.ToFloat64(configReloadsTotal.WithLabelValues("success")), 0)
+
+	require.NoError(t, afero.WriteFile(fs, path, []byte(invalidJson), 0o600))
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(configReloadsTotal.WithLabelValues("failure")) > failure
+	}, time.Second, 10*time.Millisecond)
+	require.InEpsilon(t, 1, testutil.ToFloat64(configReloadFailing), 0)
+
+	cancel()
+	require.NoError(t, <-errCh)
+	require.NoError(t, WatchConfiguration(context.TODO(), fs, nil, path, 0, nil, nil))
+	require.NoError(t, WatchConfiguration(context.TODO(), fs, nil, path, -time.Second, nil, nil))
+}
+
+func TestWatchConfigurationRetry(t *testing.T) {
+	fs, path, err := fsWithContent(validAzureDevOps)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	attempts := 0
+	reloaded := make(chan *Configuration)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- WatchConfiguration(ctx, fs, nil, path, 10*time.Millisecond, func(cfg *Configuration) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("transient error")
+			}
+			reloaded <- cfg
+			return nil
+		}, nil)
+	}()
+
+	// A configuration which cannot be applied is retried without changes to the file
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, afero.WriteFile(fs, path, []byte(validGitLab), 0o600))
+	cfg := <-reloaded
+	require.EqualValues(t, GitLabProviderType, cfg.Organizations[0].Provider)
+	require.Equal(t, 3, attempts)
+	require.Zero(t, testutil.ToFloat64(configReloadFailing))
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestWatchCredentials(t *testing.T) {
+	fs, path, err := fsWithContent(credentialReferences)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, "/var/run/secrets/pat", []byte("file-pat"), 0o600))
+	t.Setenv("GIT_AUTH_PROXY_TEST_PAT", "env-pat")
+	t.Setenv("GIT_AUTH_PROXY_TEST_TOKEN", "env-token")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "git-auth-proxy", Name: "github"},
+		Data:       map[string][]byte{"private-key": []byte("private-key")},
+	}
+	client := fake.NewSimpleClientset(secret)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	reloaded := make(chan *Configuration)
+	updated := make(chan *Configuration)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- WatchConfiguration(ctx, fs, client, path, 10*time.Millisecond, func(cfg *Configuration) error {
+			reloaded <- cfg
+			return nil
+		}, func(cfg *Configuration) error {
+			updated <- cfg
+			return nil
+		})
+	}()
+
+	// Rotating a referenced credential only updates the credentials when the file has not changed
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, afero.WriteFile(fs, "/var/run/secrets/pat", []byte("rotated-pat"), 0o600))
+	cfg := <-updated
+	require.Equal(t, "rotated-pat", cfg.Organizations[0].AzureDevOps.Pat)
+	require.Equal(t, "private-key", cfg.Organizations[2].GitHub.PrivateKey)
+
+	secret.Data["private-key"] = []byte("rotated-private-key")
+	_, err = client.CoreV1().Secrets("git-auth-proxy").Update(ctx, secret, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	cfg = <-updated
+	require.Equal(t, "rotated-private-key", cfg.Organizations[2].GitHub.PrivateKey)
+
+	// Changes to the file reload the configuration
+	require.NoError(t, afero.WriteFile(fs, path, []byte(validGitLab), 0o600))
+	cfg = <-reloaded
+	require.EqualValues(t, GitLabProviderType, cfg.Organizations[0].Provider)
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestWatchCredentialsWithoutReload(t *testing.T) {
+	fs, path, err := fsWithContent(credentialReferences)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, "/var/run/secrets/pat", []byte("file-pat"), 0o600))
+	t.Setenv("GIT_AUTH_PROXY_TEST_PAT", "env-pat")
+	t.Setenv("GIT_AUTH_PROXY_TEST_TOKEN", "env-token")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "git-auth-proxy", Name: "github"},
+		Data:       map[string][]byte{"private-key": []byte("private-key")},
+	}
+	client := fake.NewSimpleClientset(secret)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	updated := make(chan *Configuration)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- WatchConfiguration(ctx, fs, client, path, 10*time.Millisecond, nil, func(cfg *Configuration) error {
+			updated <- cfg
+			return nil
+		})
+	}()
+
+	// Changes to the file are ignored while the referenced credentials are still updated
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, afero.WriteFile(fs, path, []byte(validGitLab), 0o600))
+	require.NoError(t, afero.WriteFile(fs, "/var/run/secrets/pat", []byte("rotated-pat"), 0o600))
+	cfg := <-updated
+	require.EqualValues(t, AzureDevOpsProviderType, cfg.Organizations[0].Provider)
+	require.Equal(t, "rotated-pat", cfg.Organizations[0].AzureDevOps.Pat)
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
@@ -0,0 +1,514 @@
+package crd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/xenitab/git-auth-proxy/pkg/auth"
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+const anyNamespace = "*"
+
+// Controller reconciles GitOrganization and GitRepositoryAccess resources together with the configuration file into
+// the configuration of the authorizer.
+type Controller struct {
+	client dynamic.Interface
+	authz  *auth.Authorizer
+
+	mu         sync.Mutex
+	base       *config.Configuration
+	applied    *config.Configuration
+	generation uint64
+	trigger    chan struct{}
+
+	// statusMu orders the status updates of reconciliations, which are done without holding mu
+	statusMu         sync.Mutex
+	statusGeneration uint64
+
+	organizations cache.Store
+	accesses      cache.Store
+}
+
+func NewController(client dynamic.Interface, authz *auth.Authorizer, base *config.Configuration) *Controller {
+	return &Controller{
+		client:  client,
+		authz:   authz,
+		base:    base,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// SetConfiguration replaces the configuration file and reconciles it together with the resources.
+func (c *Controller) SetConfiguration(ctx context.Context, cfg *config.Configuration) error {
+	c.mu.Lock()
+	c.base = cfg
+	c.mu.Unlock()
+	return c.reconcile(ctx)
+}
+
+// SetCredentials replaces the configuration file after only its credentials have changed. The credentials are updated
+// without reconciling the resources, as organizations of resources cannot reference credentials.
+func (c *Controller) SetCredentials(cfg *config.Configuration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.authz.UpdateCredentials(cfg); err != nil {
+		return err
+	}
+	c.base = cfg
+	// The applied configuration is updated so that the next reconciliation does not reload the configuration
+	if c.applied != nil {
+		applied := *c.applied
+		applied.Organizations = slices.Clone(applied.Organizations)
+		for i, o := range applied.Organizations {
+			idx := slices.IndexFunc(cfg.Organizations, func(other *config.Organization) bool {
+				return other.Host == o.Host && other.Name == o.Name
+			})
+			if idx >= 0 {
+				applied.Organizations[i] = cfg.Organizations[idx]
+			}
+		}
+		c.applied = &applied
+	}
+	return nil
+}
+
+func (c *Controller) Start(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("crd")
+	log.Info("Starting controller")
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.client, 0)
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.queue() },
+		UpdateFunc: func(interface{}, interface{}) { c.queue() },
+		DeleteFunc: func(interface{}) { c.queue() },
+	}
+	orgInformer := factory.ForResource(GitOrganizationResource).Informer()
+	if _, err := orgInformer.AddEventHandler(handler); err != nil {
+		return err
+	}
+	accessInformer := factory.ForResource(GitRepositoryAccessResource).Informer()
+	if _, err := accessInformer.AddEventHandler(handler); err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), orgInformer.HasSynced, accessInformer.HasSynced) {
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	c.organizations = orgInformer.GetStore()
+	c.accesses = accessInformer.GetStore()
+	c.mu.Unlock()
+
+	c.queue()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("Controller stopped")
+			return nil
+		case <-c.trigger:
+			if err := c.reconcile(ctx); err != nil {
+				log.Error(err, "could not reconcile resources")
+			}
+		}
+	}
+}
+
+func (c *Controller) queue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// reconciliation is the outcome of applying the resources, which is written to the status of the resources.
+type reconciliation struct {
+	generation uint64
+	orgs       []*GitOrganization
+	accesses   []*GitRepositoryAccess
+	invalid    []*invalidResource
+	results    map[string]*result
+}
+
+// reconcile builds the configuration from the resources and applies it, the status of the resources is updated with
+// the result. Resources which are invalid are left out of the configuration instead of failing the reconciliation.
+func (c *Controller) reconcile(ctx context.Context) error {
+	rec, err := c.apply(ctx)
+	if rec == nil {
+		return err
+	}
+	// Statuses are updated without holding the lock so that the configuration file can be replaced meanwhile
+	return errors.Join(err, c.updateStatuses(ctx, rec))
+}
+
+// apply builds the configuration from the resources and the configuration file and reloads the authorizer if it has
+// changed. It returns nil if the resources are not known yet.
+func (c *Controller) apply(ctx context.Context) (*reconciliation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The resources are only known once the informers have synced
+	if c.organizations == nil || c.accesses == nil {
+		return nil, nil
+	}
+
+	orgs, invalidOrgs, err := listResources[GitOrganization](c.organizations, GitOrganizationResource)
+	if err != nil {
+		return nil, err
+	}
+	accesses, invalidAccesses, err := listResources[GitRepositoryAccess](c.accesses, GitRepositoryAccessResource)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, results := buildConfiguration(c.base, orgs, accesses)
+	cfg, err = config.ValidateConfiguration(cfg)
+	if err == nil && !reflect.DeepEqual(cfg, c.applied) {
+		err = c.authz.Reload(ctx, cfg)
+		if err == nil {
+			c.applied = cfg
+		}
+	}
+	if err != nil {
+		for _, res := range results {
+			if res.err == nil {
+				res.err = &conditionError{reason: "ReloadFailed", err: err}
+			}
+		}
+		err = fmt.Errorf("could not apply configuration: %w", err)
+	}
+	c.generation++
+	return &reconciliation{
+		generation: c.generation,
+		orgs:       orgs,
+		accesses:   accesses,
+		invalid:    append(invalidOrgs, invalidAccesses...),
+		results:    results,
+	}, err
+}
+
+// updateStatuses writes the results of the reconciliation to the status of the resources. Results of a reconciliation
+// which are older than the last written results are skipped, so that they cannot replace newer statuses.
+func (c *Controller) updateStatuses(ctx context.Context, rec *reconciliation) error {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if rec.generation < c.statusGeneration {
+		return nil
+	}
+	c.statusGeneration = rec.generation
+
+	errs := []error{}
+	for _, org := range rec.orgs {
+		status := Status{Conditions: slices.Clone(org.Status.Conditions)}
+		meta.SetStatusCondition(&status.Conditions, getCondition(org.Generation, rec.results[resultKey(&org.ObjectMeta)].err))
+		if reflect.DeepEqual(status, org.Status) {
+			continue
+		}
+		if err := c.updateStatus(ctx, GitOrganizationResource, &org.ObjectMeta, status); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, access := range rec.accesses {
+		res := rec.results[resultKey(&access.ObjectMeta)]
+		status := GitRepositoryAccessStatus{Conditions: slices.Clone(access.Status.Conditions), SecretName: res.secretName}
+		meta.SetStatusCondition(&status.Conditions, getCondition(access.Generation, res.err))
+		if reflect.DeepEqual(status, access.Status) {
+			continue
+		}
+		if err := c.updateStatus(ctx, GitRepositoryAccessResource, &access.ObjectMeta, status); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, inv := range rec.invalid {
+		status := Status{Conditions: slices.Clone(inv.status.Conditions)}
+		meta.SetStatusCondition(&status.Conditions, getCondition(inv.objMeta.Generation, &conditionError{reason: "Invalid", err: inv.err}))
+		if reflect.DeepEqual(status, inv.status) {
+			continue
+		}
+		if err := c.updateStatus(ctx, inv.gvr, inv.objMeta, status); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Controller) updateStatus(ctx context.Context, gvr schema.GroupVersionResource, objMeta *metav1.ObjectMeta, status any) error {
+	obj, err := c.client.Resource(gvr).Namespace(objMeta.Namespace).Get(ctx, objMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get %s %s: %w", gvr.Resource, objMeta.Name, err)
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	statusObj := map[string]interface{}{}
+	if err := json.Unmarshal(b, &statusObj); err != nil {
+		return err
+	}
+	obj.Object["status"] = statusObj
+	_, err = c.client.Resource(gvr).Namespace(objMeta.Namespace).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not update status of %s %s: %w", gvr.Resource, objMeta.Name, err)
+	}
+	return nil
+}
+
+// result is the outcome of reconciling a single resource.
+type result struct {
+	err        *conditionError
+	secretName string
+}
+
+// conditionError is an error which is reported in the Ready condition of a resource.
+type conditionError struct {
+	reason string
+	err    error
+}
+
+func (e *conditionError) Error() string {
+	return e.err.Error()
+}
+
+func getCondition(generation int64, err *conditionError) metav1.Condition {
+	if err != nil {
+		return metav1.Condition{
+			Type:               ReadyCondition,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: generation,
+			Reason:             err.reason,
+			Message:            err.Error(),
+		}
+	}
+	return metav1.Condition{
+		Type:               ReadyCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "Applied",
+		Message:            "the resource has been applied",
+	}
+}
+
+func resultKey(objMeta *metav1.ObjectMeta) string {
+	return objMeta.Namespace + "/" + objMeta.Name
+}
+
+// buildConfiguration adds the organizations and the repositories of the resources to the configuration file. The
+// repositories of the accesses are grouped so that each repository has a single endpoint with a grant per namespace.
+func buildConfiguration(
+	base *config.Configuration,
+	orgs []*GitOrganization,
+	accesses []*GitRepositoryAccess,
+) (*config.Configuration, map[string]*result) {
+	results := map[string]*result{}
+	cfg := &config.Configuration{
+		ServiceAccountAuth: base.ServiceAccountAuth,
+		Organizations:      slices.Clone(base.Organizations),
+	}
+	hosts := map[string]bool{}
+	for _, o := range base.Organizations {
+		hosts[o.Host+"/"+o.Name] = true
+	}
+
+	orgsByName := map[string]*GitOrganization{}
+	validators := map[string]*auth.RepositoryValidator{}
+	for _, org := range orgs {
+		res := &result{}
+		results[resultKey(&org.ObjectMeta)] = res
+		key := org.Spec.Host + "/" + org.Spec.Name
+		if hosts[key] {
+			err := fmt.Errorf("organization %s on host %s is already configured", org.Spec.Name, org.Spec.Host)
+			res.err = &conditionError{reason: "Conflict", err: err}
+			continue
+		}
+		validator, err := validateOrganization(base, org.Spec.Organization)
+		if err != nil {
+			res.err = &conditionError{reason: "Invalid", err: err}
+			continue
+		}
+		if err := org.Spec.Limits.validate(); err != nil {
+			res.err = &conditionError{reason: "Invalid", err: err}
+			continue
+		}
+		hosts[key] = true
+		orgsByName[org.Name] = org
+		validators[org.Name] = validator
+	}
+
+	repositories := map[string]map[string]*config.Repository{}
+	for _, access := range accesses {
+		res := &result{}
+		results[resultKey(&access.ObjectMeta)] = res
+		org, ok := orgsByName[access.Spec.Organization]
+		if !ok {
+			err := fmt.Errorf("organization %s does not exist or is not ready", access.Spec.Organization)
+			res.err = &conditionError{reason: "OrganizationNotReady", err: err}
+			continue
+		}
+		if !slices.Contains(org.Spec.AllowedNamespaces, anyNamespace) &&
+			!slices.Contains(org.Spec.AllowedNamespaces, access.Namespace) {
+			err := fmt.Errorf("namespace %s is not allowed to access organization %s", access.Namespace, access.Spec.Organization)
+			res.err = &conditionError{reason: "NamespaceNotAllowed", err: err}
+			continue
+		}
+		// Patterns would give a namespace access to repositories which the organization does not know of yet
+		if access.Spec.Repository == "" || strings.ContainsAny(access.Spec.Repository, "*?[") {
+			err := fmt.Errorf("repository %q is not a valid repository name", access.Spec.Repository)
+			res.err = &conditionError{reason: "Invalid", err: err}
+			continue
+		}
+		if !org.Spec.Limits.isRepositoryAllowed(access.Spec.Project, access.Spec.Repository) {
+			err := fmt.Errorf("repository %s is not allowed by organization %s", access.Spec.Repository, access.Spec.Organization)
+			res.err = &conditionError{reason: "RepositoryNotAllowed", err: err}
+			continue
+		}
+		ns := &config.Namespace{
+			Name:            access.Namespace,
+			Access:          access.Spec.Access,
+			AllowedRoutes:   access.Spec.AllowedRoutes,
+			AllowedRefs:     access.Spec.AllowedRefs,
+			ServiceAccounts: access.Spec.ServiceAccounts,
+		}
+		if err := org.Spec.Limits.apply(ns); err != nil {
+			res.err = &conditionError{reason: "LimitExceeded", err: err}
+			continue
+		}
+		repo := &config.Repository{Project: access.Spec.Project, Name: access.Spec.Repository, Namespaces: []*config.Namespace{ns}}
+		if err := validators[org.Name].Validate(repo); err != nil {
+			res.err = &conditionError{reason: "Invalid", err: err}
+			continue
+		}
+
+		if repositories[org.Name] == nil {
+			repositories[org.Name] = map[string]*config.Repository{}
+		}
+		repoKey := repo.Project + "/" + repo.Name
+		existing, ok := repositories[org.Name][repoKey]
+		if !ok {
+			repositories[org.Name][repoKey] = repo
+		} else {
+			if slices.ContainsFunc(existing.Namespaces, func(other *config.Namespace) bool { return other.Name == ns.Name }) {
+				err := fmt.Errorf("namespace %s already has access to repository %s", ns.Name, repoKey)
+				res.err = &conditionError{reason: "Conflict", err: err}
+				continue
+			}
+			existing.Namespaces = append(existing.Namespaces, ns)
+		}
+		if len(ns.ServiceAccounts) == 0 {
+			res.secretName = org.Spec.Organization.GetSecretName(repo)
+		}
+	}
+
+	for _, org := range orgs {
+		if _, ok := orgsByName[org.Name]; !ok {
+			continue
+		}
+		o := org.Spec.Organization
+		o.Repositories = slices.Clone(o.Repositories)
+		keys := []string{}
+		for key := range repositories[org.Name] {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			o.Repositories = append(o.Repositories, repositories[org.Name][key])
+		}
+		if len(o.Repositories) == 0 && len(o.Scopes) == 0 {
+			continue
+		}
+		cfg.Organizations = append(cfg.Organizations, &o)
+	}
+	return cfg, results
+}
+
+// validateOrganization validates the organization in the same way as an organization in the configuration file, and
+// returns a validator for the repositories of its accesses so that the provider is only created once.
+func validateOrganization(base *config.Configuration, o config.Organization) (*auth.RepositoryValidator, error) {
+	// References could otherwise be used to read files and secrets which the creator of the resource has no access to
+	if o.HasCredentialReferences() {
+		return nil, errors.New("credential references are only supported in the configuration file")
+	}
+	// Organizations without repositories are valid as repositories are added by the accesses
+	if len(o.Repositories) == 0 && len(o.Scopes) == 0 {
+		o.Scopes = []*config.Scope{}
+	}
+	cfg, err := config.ValidateConfiguration(&config.Configuration{
+		ServiceAccountAuth: base.ServiceAccountAuth,
+		Organizations:      []*config.Organization{&o},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewRepositoryValidator(cfg.Organizations[0])
+}
+
+// invalidResource is a resource which could not be decoded, its status is updated with the decoding error.
+type invalidResource struct {
+	gvr     schema.GroupVersionResource
+	objMeta *metav1.ObjectMeta
+	status  Status
+	err     error
+}
+
+// listResources decodes the resources in the store, sorted by namespace and name. Resources which cannot be decoded
+// are returned separately so that their status can be updated.
+func listResources[T any](store cache.Store, gvr schema.GroupVersionResource) ([]*T, []*invalidResource, error) {
+	objs := store.List()
+	slices.SortFunc(objs, func(a, b interface{}) int {
+		return strings.Compare(resultKey(metaOf(a)), resultKey(metaOf(b)))
+	})
+	resources := []*T{}
+	invalid := []*invalidResource{}
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, nil, errors.New("could not convert to unstructured")
+		}
+		b, err := u.MarshalJSON()
+		if err != nil {
+			return nil, nil, err
+		}
+		resource := new(T)
+		// Decoding errors are not returned as an invalid resource should not prevent other resources from being applied
+		if err := json.Unmarshal(b, resource); err != nil {
+			inv := &invalidResource{
+				gvr:     gvr,
+				objMeta: &metav1.ObjectMeta{Namespace: u.GetNamespace(), Name: u.GetName(), Generation: u.GetGeneration()},
+				err:     fmt.Errorf("could not decode resource: %w", err),
+			}
+			// The conditions are kept if the status can be decoded, so that the transition time is not reset
+			if statusObj, ok := u.Object["status"]; ok {
+				if sb, err := json.Marshal(statusObj); err == nil {
+					//nolint: errcheck //ignore
+					json.Unmarshal(sb, &inv.status)
+				}
+			}
+			invalid = append(invalid, inv)
+			continue
+		}
+		resources = append(resources, resource)
+	}
+	return resources, invalid, nil
+}
+
+func metaOf(obj interface{}) *metav1.ObjectMeta {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return &metav1.ObjectMeta{}
+	}
+	return &metav1.ObjectMeta{Namespace: u.GetNamespace(), Name: u.GetName()}
+}
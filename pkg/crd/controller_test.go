@@ -0,0 +1,237 @@
+package crd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/xenitab/git-auth-proxy/pkg/auth"
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func toUnstructured(t *testing.T, kind string, obj any) *unstructured.Unstructured {
+	t.Helper()
+	b, err := json.Marshal(obj)
+	require.NoError(t, err)
+	u := &unstructured.Unstructured{}
+	require.NoError(t, json.Unmarshal(b, &u.Object))
+	u.SetAPIVersion(Group + "/" + Version)
+	u.SetKind(kind)
+	return u
+}
+
+func newOrganization(t *testing.T, name, orgName string, allowedNamespaces ...string) *unstructured.Unstructured {
+	t.Helper()
+	return toUnstructured(t, "GitOrganization", &GitOrganization{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: GitOrganizationSpec{
+			Organization: config.Organization{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "dev.azure.com",
+				Name:     orgName,
+				AzureDevOps: config.AzureDevOps{
+					Pat: "pat",
+				},
+			},
+			AllowedNamespaces: allowedNamespaces,
+		},
+	})
+}
+
+func newAccess(t *testing.T, namespace, name string, spec GitRepositoryAccessSpec) *unstructured.Unstructured {
+	t.Helper()
+	return toUnstructured(t, "GitRepositoryAccess", &GitRepositoryAccess{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       spec,
+	})
+}
+
+func getReadyCondition(t *testing.T, client *dynamicfake.FakeDynamicClient, gvr schema.GroupVersionResource, namespace, name string) (*metav1.Condition, string) {
+	t.Helper()
+	u, err := client.Resource(gvr).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	// Only the status is decoded as the spec of invalid resources may not be decodable
+	b, err := json.Marshal(u.Object["status"])
+	require.NoError(t, err)
+	status := &GitRepositoryAccessStatus{}
+	require.NoError(t, json.Unmarshal(b, status))
+	return meta.FindStatusCondition(status.Conditions, ReadyCondition), status.SecretName
+}
+
+func TestController(t *testing.T) {
+	base := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "dev.azure.com",
+				Scheme:   "https",
+				Name:     "file",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "pat",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "default"}},
+					},
+				},
+			},
+		},
+	}
+	base, err := config.ValidateConfiguration(base)
+	require.NoError(t, err)
+	authz, err := auth.NewAuthorizer(base)
+	require.NoError(t, err)
+	fileEndpoint, err := authz.GetEndpointById("dev.azure.com-file-proj-repo")
+	require.NoError(t, err)
+
+	// A field with the wrong type cannot be decoded
+	undecodable := newAccess(t, "team-a", "undecodable", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo"})
+	require.NoError(t, unstructured.SetNestedField(undecodable.Object, "refs/heads/main", "spec", "allowedRefs"))
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		GitOrganizationResource:     "GitOrganizationList",
+		GitRepositoryAccessResource: "GitRepositoryAccessList",
+	},
+		newOrganization(t, "org", "org", "team-a", "team-b", "team-c"),
+		newOrganization(t, "conflict", "file", "*"),
+		newAccess(t, "team-a", "repo", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo"}),
+		newAccess(t, "team-b", "repo", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo", Access: config.ReadAccessLevel}),
+		newAccess(t, "team-c", "service-accounts", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo", ServiceAccounts: []string{"default"}}),
+		newAccess(t, "team-a", "repo-duplicate", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo"}),
+		newAccess(t, "team-d", "repo", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo"}),
+		newAccess(t, "team-a", "missing", GitRepositoryAccessSpec{Organization: "missing", Project: "proj", Repository: "repo"}),
+		newAccess(t, "team-a", "invalid", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "other", Access: "admin"}),
+		newAccess(t, "team-a", "pattern", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "*"}),
+		undecodable,
+	)
+	controller := NewController(client, authz, base)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		err := controller.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := authz.GetEndpointById("dev.azure.com-org-proj-repo")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	endpoint, err := authz.GetEndpointById("dev.azure.com-org-proj-repo")
+	require.NoError(t, err)
+	require.Len(t, endpoint.Grants, 3)
+	for _, namespace := range []string{"team-a", "team-b", "team-c"} {
+		_, err := endpoint.GetGrant(namespace)
+		require.NoError(t, err)
+	}
+	// Endpoints of the configuration file keep their tokens
+	fileEndpointAfter, err := authz.GetEndpointById("dev.azure.com-file-proj-repo")
+	require.NoError(t, err)
+	require.Equal(t, fileEndpoint.Grants[0].Token, fileEndpointAfter.Grants[0].Token)
+
+	tests := []struct {
+		gvr        schema.GroupVersionResource
+		namespace  string
+		name       string
+		status     metav1.ConditionStatus
+		reason     string
+		secretName string
+	}{
+		{gvr: GitOrganizationResource, name: "org", status: metav1.ConditionTrue, reason: "Applied"},
+		{gvr: GitOrganizationResource, name: "conflict", status: metav1.ConditionFalse, reason: "Conflict"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-a", name: "repo", status: metav1.ConditionTrue, reason: "Applied", secretName: "org-proj-repo"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-b", name: "repo", status: metav1.ConditionTrue, reason: "Applied", secretName: "org-proj-repo"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-c", name: "service-accounts", status: metav1.ConditionTrue, reason: "Applied"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-a", name: "repo-duplicate", status: metav1.ConditionFalse, reason: "Conflict"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-d", name: "repo", status: metav1.ConditionFalse, reason: "NamespaceNotAllowed"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-a", name: "missing", status: metav1.ConditionFalse, reason: "OrganizationNotReady"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-a", name: "invalid", status: metav1.ConditionFalse, reason: "Invalid"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-a", name: "pattern", status: metav1.ConditionFalse, reason: "Invalid"},
+		{gvr: GitRepositoryAccessResource, namespace: "team-a", name: "undecodable", status: metav1.ConditionFalse, reason: "Invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+"/"+tt.name, func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				condition, _ := getReadyCondition(t, client, tt.gvr, tt.namespace, tt.name)
+				return condition != nil
+			}, 5*time.Second, 10*time.Millisecond)
+			condition, secretName := getReadyCondition(t, client, tt.gvr, tt.namespace, tt.name)
+			require.Equal(t, tt.status, condition.Status)
+			require.Equal(t, tt.reason, condition.Reason)
+			require.Equal(t, tt.secretName, secretName)
+		})
+	}
+
+	// Updating the credentials of the configuration file does not reload the configuration when reconciling again
+	select {
+	case <-authz.Updated():
+	default:
+	}
+	rotated := *base.Organizations[0]
+	rotated.AzureDevOps.Pat = "rotated"
+	err = controller.SetCredentials(&config.Configuration{Organizations: []*config.Organization{&rotated}})
+	require.NoError(t, err)
+	require.NoError(t, controller.reconcile(ctx))
+	require.Empty(t, authz.Updated())
+	fileEndpointRotated, err := authz.GetEndpointById("dev.azure.com-file-proj-repo")
+	require.NoError(t, err)
+	require.Same(t, fileEndpointAfter, fileEndpointRotated)
+
+	// Removing the organization from the configuration file resolves the conflict
+	err = controller.SetConfiguration(ctx, &config.Configuration{Organizations: []*config.Organization{}})
+	require.NoError(t, err)
+	_, err = authz.GetEndpointById("dev.azure.com-file-proj-repo")
+	require.Error(t, err)
+	condition, _ := getReadyCondition(t, client, GitOrganizationResource, "", "conflict")
+	require.Equal(t, metav1.ConditionTrue, condition.Status)
+
+	// Deleting an access removes the namespace from the endpoint
+	err = client.Resource(GitRepositoryAccessResource).Namespace("team-b").Delete(ctx, "repo", metav1.DeleteOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		endpoint, err := authz.GetEndpointById("dev.azure.com-org-proj-repo")
+		return err == nil && len(endpoint.Grants) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The configuration file can be replaced while statuses are updated
+	blocked := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	client.PrependReactor("update", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" {
+			return false, nil, nil
+		}
+		select {
+		case blocked <- struct{}{}:
+		default:
+		}
+		<-unblock
+		return false, nil, nil
+	})
+	_, err = client.Resource(GitRepositoryAccessResource).Namespace("team-b").Create(ctx,
+		newAccess(t, "team-b", "repo", GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo"}), metav1.CreateOptions{})
+	require.NoError(t, err)
+	<-blocked
+	updated := make(chan error)
+	go func() {
+		updated <- controller.SetCredentials(&config.Configuration{Organizations: []*config.Organization{}})
+	}()
+	select {
+	case err := <-updated:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("credentials were not updated while statuses were updated")
+	}
+	close(unblock)
+}
@@ -0,0 +1,146 @@
+package crd
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+// validate checks the limits of an organization, so that invalid limits are reported on the organization instead of
+// on each of its accesses.
+func (l *Limits) validate() error {
+	switch l.MaxAccess {
+	case "", config.ReadAccessLevel, config.WriteAccessLevel:
+	default:
+		return fmt.Errorf("invalid max access %q", l.MaxAccess)
+	}
+	for _, pattern := range l.AllowedRepositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+		}
+	}
+	for _, ref := range l.AllowedRefs {
+		if !strings.HasPrefix(ref, "refs/") {
+			return fmt.Errorf("ref pattern %s has to start with refs/", ref)
+		}
+	}
+	for _, raw := range l.AllowedRoutes {
+		if _, _, err := parseRoute(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRepositoryAllowed returns true if the repository name or project/name matches one of the allowed repositories.
+func (l *Limits) isRepositoryAllowed(project, repository string) bool {
+	if len(l.AllowedRepositories) == 0 {
+		return true
+	}
+	names := []string{strings.ToLower(repository)}
+	if project != "" {
+		names = append(names, strings.ToLower(project+"/"+repository))
+	}
+	for _, pattern := range l.AllowedRepositories {
+		for _, name := range names {
+			if ok, err := path.Match(strings.ToLower(pattern), name); err == nil && ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply restricts the settings of the namespace to the limits. The access is reduced to the max access, while refs
+// and routes which are not within the limits are returned as errors as leaving them out would widen the access.
+func (l *Limits) apply(ns *config.Namespace) error {
+	if ns.Access == "" || (ns.Access == config.WriteAccessLevel && l.MaxAccess != config.WriteAccessLevel) {
+		ns.Access = config.ReadAccessLevel
+	}
+	if len(l.AllowedRefs) > 0 {
+		if len(ns.AllowedRefs) == 0 {
+			ns.AllowedRefs = slices.Clone(l.AllowedRefs)
+		}
+		for _, ref := range ns.AllowedRefs {
+			if !slices.ContainsFunc(l.AllowedRefs, func(pattern string) bool { return isRefWithin(pattern, ref) }) {
+				return fmt.Errorf("allowed ref %s is not within the allowed refs of the organization", ref)
+			}
+		}
+	}
+	if len(l.AllowedRoutes) > 0 {
+		if len(ns.AllowedRoutes) == 0 {
+			ns.AllowedRoutes = slices.Clone(l.AllowedRoutes)
+		}
+		for _, raw := range ns.AllowedRoutes {
+			within := false
+			for _, limit := range l.AllowedRoutes {
+				ok, err := isRouteWithin(limit, raw)
+				if err != nil {
+					return err
+				}
+				within = within || ok
+			}
+			if !within {
+				return fmt.Errorf("allowed route %q is not within the allowed routes of the organization", raw)
+			}
+		}
+	}
+	return nil
+}
+
+// isRefWithin returns true if every ref matched by the ref pattern is also matched by the limit. The pattern is matched
+// as a ref against the limit, which works as a * in the pattern can only be matched by a * in the limit.
+func isRefWithin(limit, pattern string) bool {
+	expr := strings.ReplaceAll(regexp.QuoteMeta(limit), `\*`, `.*`)
+	ok, err := regexp.MatchString(fmt.Sprintf("^%s$", expr), pattern)
+	return err == nil && ok
+}
+
+// isRouteWithin returns true if the route is the same path as the limit or a sub path of it, and only permits methods
+// which are permitted by the limit.
+func isRouteWithin(limit, raw string) (bool, error) {
+	limitMethods, limitPath, err := parseRoute(limit)
+	if err != nil {
+		return false, err
+	}
+	methods, routePath, err := parseRoute(raw)
+	if err != nil {
+		return false, err
+	}
+	if len(limitMethods) > 0 {
+		if len(methods) == 0 {
+			return false, nil
+		}
+		for _, method := range methods {
+			if !slices.Contains(limitMethods, method) {
+				return false, nil
+			}
+		}
+	}
+	return routePath == limitPath || strings.HasPrefix(routePath, limitPath+"/"), nil
+}
+
+// parseRoute parses a route in the format "[METHOD,...] <path>" into its upper case methods and lower case path, in
+// the same way as the authorizer which matches paths case insensitive.
+func parseRoute(raw string) ([]string, string, error) {
+	fields := strings.Fields(raw)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, "", fmt.Errorf("invalid route %q", raw)
+	}
+	routePath := strings.ToLower(fields[len(fields)-1])
+	if !strings.HasPrefix(routePath, "/") {
+		return nil, "", fmt.Errorf("route path has to start with a slash %q", raw)
+	}
+	if len(fields) == 1 {
+		return nil, routePath, nil
+	}
+	methods := []string{}
+	for _, method := range strings.Split(fields[0], ",") {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	return methods, routePath, nil
+}
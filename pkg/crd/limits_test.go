@@ -0,0 +1,206 @@
+package crd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+func TestLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		valid  bool
+	}{
+		{name: "empty", limits: Limits{}, valid: true},
+		{name: "all", limits: Limits{MaxAccess: config.WriteAccessLevel, AllowedRepositories: []string{"proj/*"}, AllowedRefs: []string{"refs/heads/*"}, AllowedRoutes: []string{"GET /api"}}, valid: true},
+		{name: "max access", limits: Limits{MaxAccess: "admin"}, valid: false},
+		{name: "repository pattern", limits: Limits{AllowedRepositories: []string{"["}}, valid: false},
+		{name: "ref", limits: Limits{AllowedRefs: []string{"heads/*"}}, valid: false},
+		{name: "route", limits: Limits{AllowedRoutes: []string{"api"}}, valid: false},
+		{name: "route fields", limits: Limits{AllowedRoutes: []string{"GET /api /other"}}, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.validate()
+			if tt.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLimitsIsRepositoryAllowed(t *testing.T) {
+	limits := Limits{AllowedRepositories: []string{"team-a-*", "infra/*"}}
+	require.True(t, limits.isRepositoryAllowed("proj", "team-a-config"))
+	require.True(t, limits.isRepositoryAllowed("", "Team-A-Config"))
+	require.True(t, limits.isRepositoryAllowed("infra", "fleet"))
+	require.False(t, limits.isRepositoryAllowed("proj", "fleet"))
+	require.False(t, limits.isRepositoryAllowed("", "team-b-config"))
+	require.True(t, (&Limits{}).isRepositoryAllowed("proj", "fleet"))
+}
+
+func TestLimitsApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   Limits
+		ns       config.Namespace
+		expected config.Namespace
+		err      bool
+	}{
+		{
+			name:     "access defaults to read",
+			limits:   Limits{MaxAccess: config.WriteAccessLevel},
+			ns:       config.Namespace{},
+			expected: config.Namespace{Access: config.ReadAccessLevel},
+		},
+		{
+			name:     "write access is reduced to read",
+			limits:   Limits{},
+			ns:       config.Namespace{Access: config.WriteAccessLevel},
+			expected: config.Namespace{Access: config.ReadAccessLevel},
+		},
+		{
+			name:     "write access is allowed",
+			limits:   Limits{MaxAccess: config.WriteAccessLevel},
+			ns:       config.Namespace{Access: config.WriteAccessLevel},
+			expected: config.Namespace{Access: config.WriteAccessLevel},
+		},
+		{
+			name:     "refs default to the limits",
+			limits:   Limits{AllowedRefs: []string{"refs/heads/feature/*"}},
+			ns:       config.Namespace{},
+			expected: config.Namespace{Access: config.ReadAccessLevel, AllowedRefs: []string{"refs/heads/feature/*"}},
+		},
+		{
+			name:     "refs within the limits",
+			limits:   Limits{AllowedRefs: []string{"refs/heads/feature/*"}},
+			ns:       config.Namespace{AllowedRefs: []string{"refs/heads/feature/team-a/*", "refs/heads/feature/main"}},
+			expected: config.Namespace{Access: config.ReadAccessLevel, AllowedRefs: []string{"refs/heads/feature/team-a/*", "refs/heads/feature/main"}},
+		},
+		{
+			name:   "refs wider than the limits",
+			limits: Limits{AllowedRefs: []string{"refs/heads/feature/*"}},
+			ns:     config.Namespace{AllowedRefs: []string{"refs/heads/*"}},
+			err:    true,
+		},
+		{
+			name:   "refs outside of the limits",
+			limits: Limits{AllowedRefs: []string{"refs/heads/feature/*"}},
+			ns:     config.Namespace{AllowedRefs: []string{"refs/heads/main"}},
+			err:    true,
+		},
+		{
+			name:     "routes default to the limits",
+			limits:   Limits{AllowedRoutes: []string{"GET /api/repos/{organization}/{repository}"}},
+			ns:       config.Namespace{},
+			expected: config.Namespace{Access: config.ReadAccessLevel, AllowedRoutes: []string{"GET /api/repos/{organization}/{repository}"}},
+		},
+		{
+			name:     "routes within the limits",
+			limits:   Limits{AllowedRoutes: []string{"GET,POST /api/repos/{organization}/{repository}"}},
+			ns:       config.Namespace{AllowedRoutes: []string{"get /API/repos/{organization}/{repository}/pulls", "POST /api/repos/{organization}/{repository}"}},
+			expected: config.Namespace{Access: config.ReadAccessLevel, AllowedRoutes: []string{"get /API/repos/{organization}/{repository}/pulls", "POST /api/repos/{organization}/{repository}"}},
+		},
+		{
+			name:   "routes with other methods",
+			limits: Limits{AllowedRoutes: []string{"GET /api/repos/{organization}/{repository}"}},
+			ns:     config.Namespace{AllowedRoutes: []string{"DELETE /api/repos/{organization}/{repository}"}},
+			err:    true,
+		},
+		{
+			name:   "routes with all methods",
+			limits: Limits{AllowedRoutes: []string{"GET /api/repos/{organization}/{repository}"}},
+			ns:     config.Namespace{AllowedRoutes: []string{"/api/repos/{organization}/{repository}"}},
+			err:    true,
+		},
+		{
+			name:   "routes with parent paths",
+			limits: Limits{AllowedRoutes: []string{"/api/repos/{organization}/{repository}"}},
+			ns:     config.Namespace{AllowedRoutes: []string{"/api/repos/{organization}"}},
+			err:    true,
+		},
+		{
+			name:   "routes with path prefixes",
+			limits: Limits{AllowedRoutes: []string{"/api/repos/{organization}/{repository}"}},
+			ns:     config.Namespace{AllowedRoutes: []string{"/api/repos/{organization}/{repository}-other"}},
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := tt.ns
+			err := tt.limits.apply(&ns)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, ns)
+		})
+	}
+}
+
+func TestBuildConfigurationLimits(t *testing.T) {
+	org := &GitOrganization{
+		ObjectMeta: metav1.ObjectMeta{Name: "org"},
+		Spec: GitOrganizationSpec{
+			Organization: config.Organization{
+				Provider:    config.AzureDevOpsProviderType,
+				Host:        "dev.azure.com",
+				Scheme:      "https",
+				Name:        "org",
+				AzureDevOps: config.AzureDevOps{Pat: "pat"},
+			},
+			AllowedNamespaces: []string{"*"},
+			Limits: Limits{
+				AllowedRepositories: []string{"proj/*"},
+				AllowedRefs:         []string{"refs/heads/feature/*"},
+			},
+		},
+	}
+	invalid := &GitOrganization{
+		ObjectMeta: metav1.ObjectMeta{Name: "invalid"},
+		Spec: GitOrganizationSpec{
+			Organization: config.Organization{
+				Provider:    config.AzureDevOpsProviderType,
+				Host:        "dev.azure.com",
+				Scheme:      "https",
+				Name:        "invalid",
+				AzureDevOps: config.AzureDevOps{Pat: "pat"},
+			},
+			AllowedNamespaces: []string{"*"},
+			Limits:            Limits{MaxAccess: "admin"},
+		},
+	}
+	accesses := []*GitRepositoryAccess{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "repo"},
+			Spec:       GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo", Access: config.WriteAccessLevel},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "other"},
+			Spec:       GitRepositoryAccessSpec{Organization: "org", Project: "other", Repository: "repo"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "repo"},
+			Spec:       GitRepositoryAccessSpec{Organization: "org", Project: "proj", Repository: "repo", AllowedRefs: []string{"refs/heads/main"}},
+		},
+	}
+	cfg, results := buildConfiguration(&config.Configuration{Organizations: []*config.Organization{}}, []*GitOrganization{org, invalid}, accesses)
+
+	require.Equal(t, "Invalid", results["/invalid"].err.reason)
+	require.Nil(t, results["team-a/repo"].err)
+	require.Equal(t, "RepositoryNotAllowed", results["team-a/other"].err.reason)
+	require.Equal(t, "LimitExceeded", results["team-b/repo"].err.reason)
+	require.Len(t, cfg.Organizations, 1)
+	require.Len(t, cfg.Organizations[0].Repositories, 1)
+	require.Equal(t, []*config.Namespace{
+		{Name: "team-a", Access: config.ReadAccessLevel, AllowedRefs: []string{"refs/heads/feature/*"}},
+	}, cfg.Organizations[0].Repositories[0].Namespaces)
+}
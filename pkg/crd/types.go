@@ -0,0 +1,85 @@
+package crd
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+const (
+	Group   = "git-auth-proxy.xenit.io"
+	Version = "v1alpha1"
+
+	// ReadyCondition reports if the resource has been applied to the proxy.
+	ReadyCondition = "Ready"
+)
+
+var (
+	GitOrganizationResource     = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "gitorganizations"}
+	GitRepositoryAccessResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "gitrepositoryaccesses"}
+)
+
+// GitOrganization is a cluster scoped resource which configures an organization and the credentials of its provider.
+type GitOrganization struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GitOrganizationSpec `json:"spec"`
+	Status Status              `json:"status,omitempty"`
+}
+
+// GitOrganizationSpec contains the same fields as an organization in the configuration file.
+type GitOrganizationSpec struct {
+	config.Organization `json:",inline"`
+	// AllowedNamespaces which can request access to the repositories of the organization, where * allows all namespaces.
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+	// Limits restrict the settings which the accesses of the organization can request.
+	Limits Limits `json:"limits,omitempty"`
+}
+
+// Limits are set by the administrator of an organization and take precedence over the settings of the accesses.
+type Limits struct {
+	// MaxAccess is the highest access level of the accesses and defaults to read, write access is reduced to read
+	// access unless write is allowed.
+	MaxAccess config.AccessLevel `json:"maxAccess,omitempty"`
+	// AllowedRepositories are patterns of the repositories which can be accessed, matched against the repository
+	// name or project/name, where * matches any characters except a slash. All repositories are allowed when not set.
+	AllowedRepositories []string `json:"allowedRepositories,omitempty"`
+	// AllowedRefs limits pushes of all accesses, the allowed refs of an access have to match one of the patterns.
+	AllowedRefs []string `json:"allowedRefs,omitempty"`
+	// AllowedRoutes limits the API requests of all accesses, the allowed routes of an access have to be one of the
+	// routes or a sub path of it with a subset of its methods.
+	AllowedRoutes []string `json:"allowedRoutes,omitempty"`
+}
+
+// GitRepositoryAccess is a namespaced resource which gives its namespace access to a repository of an organization.
+type GitRepositoryAccess struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GitRepositoryAccessSpec   `json:"spec"`
+	Status GitRepositoryAccessStatus `json:"status,omitempty"`
+}
+
+type GitRepositoryAccessSpec struct {
+	// Organization is the name of the GitOrganization which the repository belongs to.
+	Organization string `json:"organization"`
+	Project      string `json:"project,omitempty"`
+	Repository   string `json:"repository"`
+	// Access defaults to read when not set, and is limited by the max access of the organization.
+	Access          config.AccessLevel `json:"access,omitempty"`
+	AllowedRoutes   []string           `json:"allowedRoutes,omitempty"`
+	AllowedRefs     []string           `json:"allowedRefs,omitempty"`
+	ServiceAccounts []string           `json:"serviceAccounts,omitempty"`
+}
+
+type Status struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+type GitRepositoryAccessStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// SecretName is the name of the secret which contains the token, it is empty when service accounts are used.
+	SecretName string `json:"secretName,omitempty"`
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/xenitab/git-auth-proxy/pkg/auth"
+)
+
+const (
+	receivePackPath        = "/git-receive-pack"
+	receivePackResultType  = "application/x-git-receive-pack-result"
+	pktLineHeaderLength    = 4
+	maxPktLineLength       = 65520
+	sideBand64kDataLength  = 65515
+	sideBandDataLength     = 995
+	sideBand64kCapability  = "side-band-64k"
+	sideBandCapability     = "side-band"
+	reportStatusCapability = "report-status"
+)
+
+var (
+	// Object IDs are parsed case insensitively by git, so upper case IDs have to be accepted as well.
+	receivePackCommandRegex = regexp.MustCompile(`(?i)^[0-9a-f]{40,64} [0-9a-f]{40,64} (\S+)$`)
+	receivePackShallowRegex = regexp.MustCompile(`(?i)^shallow [0-9a-f]{40,64}$`)
+)
+
+const (
+	pushCertificateStart          = "push-cert"
+	pushCertificateSignatureStart = "-----BEGIN"
+)
+
+// pushCertificateState is the section of a push certificate which is being read.
+type pushCertificateState int
+
+const (
+	noPushCertificate pushCertificateState = iota
+	pushCertificateHeader
+	pushCertificateCommands
+	pushCertificateSignature
+)
+
+// receivePackCommands are the ref updates and capabilities sent by the client in a git-receive-pack request.
+type receivePackCommands struct {
+	refs         []string
+	capabilities []string
+}
+
+func (r *receivePackCommands) hasCapability(capability string) bool {
+	for _, c := range r.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func isReceivePackRequest(req *http.Request) bool {
+	return req.Method == http.MethodPost && strings.HasSuffix(strings.ToLower(req.URL.Path), receivePackPath)
+}
+
+// readReceivePackCommands reads the commands which precede the pack file in the request body. The body is replaced
+// so that it can still be forwarded, gzip encoded bodies are forwarded decompressed. Requests with lines which cannot
+// be parsed are rejected, as the refs which they update could otherwise not be checked.
+func readReceivePackCommands(req *http.Request) (*receivePackCommands, error) {
+	body := req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress request body: %w", err)
+		}
+		body = gz
+		req.Header.Del("Content-Encoding")
+		req.Header.Del("Content-Length")
+		req.ContentLength = -1
+	}
+
+	consumed := &bytes.Buffer{}
+	reader := bufio.NewReader(io.TeeReader(body, consumed))
+	commands := &receivePackCommands{}
+	certificate := noPushCertificate
+	for {
+		line, flush, err := readPktLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+		line, capabilities, ok := strings.Cut(line, "\x00")
+		if ok {
+			commands.capabilities = append(commands.capabilities, strings.Fields(capabilities)...)
+		}
+		// Push certificates contain the commands between the header and the signature
+		switch {
+		case certificate == noPushCertificate && len(commands.refs) == 0 && line == pushCertificateStart:
+			certificate = pushCertificateHeader
+			continue
+		case certificate == noPushCertificate && len(commands.refs) == 0 && receivePackShallowRegex.MatchString(line):
+			continue
+		case certificate == pushCertificateHeader:
+			if line == "" {
+				certificate = pushCertificateCommands
+			}
+			continue
+		case certificate == pushCertificateCommands && strings.HasPrefix(line, pushCertificateSignatureStart):
+			certificate = pushCertificateSignature
+			continue
+		case certificate == pushCertificateSignature:
+			continue
+		}
+		match := receivePackCommandRegex.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("invalid receive pack command %q", line)
+		}
+		commands.refs = append(commands.refs, match[1])
+	}
+	if len(commands.refs) == 0 {
+		return nil, errors.New("receive pack request does not contain any ref updates")
+	}
+
+	// All bytes read from the body, including those buffered past the flush packet, are replayed before the rest of the body
+	req.Body = &readCloser{
+		Reader: io.MultiReader(consumed, body),
+		Closer: req.Body,
+	}
+	return commands, nil
+}
+
+// readPktLine returns the content of the next pkt-line, or true if it is a flush packet.
+func readPktLine(r io.Reader) (string, bool, error) {
+	header := make([]byte, pktLineHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", false, fmt.Errorf("could not read pkt-line length: %w", err)
+	}
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid pkt-line length %q", header)
+	}
+	if length == 0 {
+		return "", true, nil
+	}
+	if length < pktLineHeaderLength || length > maxPktLineLength {
+		return "", false, fmt.Errorf("invalid pkt-line length %d", length)
+	}
+	data := make([]byte, length-pktLineHeaderLength)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", false, fmt.Errorf("could not read pkt-line: %w", err)
+	}
+	return string(data), false, nil
+}
+
+func pktLine(data string) string {
+	return fmt.Sprintf("%04x%s", len(data)+pktLineHeaderLength, data)
+}
+
+// checkReceivePack returns the reasons for all refs in the push which are not permitted.
+func checkReceivePack(grant *auth.Grant, commands *receivePackCommands) map[string]string {
+	denied := map[string]string{}
+	for _, ref := range commands.refs {
+		if err := grant.IsRefPermitted(ref); err != nil {
+			denied[ref] = err.Error()
+		}
+	}
+	return denied
+}
+
+// writeReceivePackReport responds with a report status which rejects all refs in the push, as the push is not forwarded
+// if any of the refs are denied.
+func writeReceivePackReport(c *gin.Context, commands *receivePackCommands, denied map[string]string) {
+	if !commands.hasCapability(reportStatusCapability) {
+		c.String(http.StatusForbidden, "push not permitted")
+		return
+	}
+
+	report := &strings.Builder{}
+	report.WriteString(pktLine("unpack ok\n"))
+	for _, ref := range commands.refs {
+		reason, ok := denied[ref]
+		if !ok {
+			reason = "push contains denied refs"
+		}
+		report.WriteString(pktLine(fmt.Sprintf("ng %s %s\n", ref, reason)))
+	}
+	report.WriteString("0000")
+
+	out := report.String()
+	switch {
+	case commands.hasCapability(sideBand64kCapability):
+		out = sideBand(out, sideBand64kDataLength)
+	case commands.hasCapability(sideBandCapability):
+		out = sideBand(out, sideBandDataLength)
+	}
+	c.Data(http.StatusOK, receivePackResultType, []byte(out))
+}
+
+// sideBand wraps the data in packets of the primary side band channel followed by a flush packet.
+func sideBand(data string, maxLength int) string {
+	out := &strings.Builder{}
+	for len(data) > 0 {
+		n := min(len(data), maxLength)
+		out.WriteString(pktLine("\x01" + data[:n]))
+		data = data[n:]
+	}
+	out.WriteString("0000")
+	return out.String()
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/git-auth-proxy/pkg/auth"
+	"github.com/xenitab/git-auth-proxy/pkg/config"
+)
+
+const (
+	oldID = "1111111111111111111111111111111111111111"
+	newID = "2222222222222222222222222222222222222222"
+)
+
+func receivePackBody(refs ...string) string {
+	body := &strings.Builder{}
+	for i, ref := range refs {
+		line := oldID + " " + newID + " " + ref
+		if i == 0 {
+			line = line + "\x00report-status side-band-64k agent=git/2.43.0"
+		}
+		body.WriteString(pktLine(line + "\n"))
+	}
+	body.WriteString("0000")
+	body.WriteString("PACK packfile data")
+	return body.String()
+}
+
+func getReceivePackGrant(t *testing.T) *auth.Grant {
+	t.Helper()
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: config.AzureDevOpsProviderType,
+				Host:     "foo",
+				Name:     "org",
+				Repositories: []*config.Repository{
+					{
+						Project:     "proj",
+						Name:        "repo",
+						Namespaces:  []*config.Namespace{{Name: "default"}},
+						AllowedRefs: []string{"refs/heads/flux-image-updates/*"},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	e, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	return e.Grants[0]
+}
+
+func TestReadReceivePackCommands(t *testing.T) {
+	body := receivePackBody("refs/heads/main", "refs/heads/flux-image-updates/app")
+	req := httptest.NewRequest(http.MethodPost, "/org/proj/_git/repo/git-receive-pack", strings.NewReader(body))
+	commands, err := readReceivePackCommands(req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"refs/heads/main", "refs/heads/flux-image-updates/app"}, commands.refs)
+	require.True(t, commands.hasCapability(reportStatusCapability))
+	require.True(t, commands.hasCapability(sideBand64kCapability))
+
+	forwarded, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, string(forwarded))
+}
+
+func TestReadReceivePackCommandsGzip(t *testing.T) {
+	body := receivePackBody("refs/heads/main")
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	_, err := gz.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/org/proj/_git/repo/git-receive-pack", compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	commands, err := readReceivePackCommands(req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"refs/heads/main"}, commands.refs)
+	require.Empty(t, req.Header.Get("Content-Encoding"))
+
+	forwarded, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, string(forwarded))
+}
+
+func TestReadReceivePackCommandsInvalid(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/org/proj/_git/repo/git-receive-pack", strings.NewReader("zzzz"))
+	_, err := readReceivePackCommands(req)
+	require.Error(t, err)
+}
+
+func TestReadReceivePackCommandsFormats(t *testing.T) {
+	upperOldID := strings.Repeat("A", 40)
+	upperNewID := strings.Repeat("B", 40)
+	tests := []struct {
+		name  string
+		lines []string
+		refs  []string
+	}{
+		{
+			name:  "upper case object ids",
+			lines: []string{upperOldID + " " + upperNewID + " refs/heads/main\x00report-status"},
+			refs:  []string{"refs/heads/main"},
+		},
+		{
+			name:  "shallow",
+			lines: []string{"shallow " + oldID, oldID + " " + newID + " refs/heads/main\x00report-status"},
+			refs:  []string{"refs/heads/main"},
+		},
+		{
+			name: "push certificate",
+			lines: []string{
+				"push-cert\x00report-status",
+				"certificate version 0.1",
+				"pusher user <user@example.com> 1700000000 +0000",
+				"pushee https://example.com/org/proj/_git/repo",
+				"nonce 1700000000-abc",
+				"",
+				oldID + " " + newID + " refs/heads/main",
+				upperOldID + " " + upperNewID + " refs/heads/other",
+				"-----BEGIN PGP SIGNATURE-----",
+				"signature",
+				"-----END PGP SIGNATURE-----",
+				"push-cert-end",
+			},
+			refs: []string{"refs/heads/main", "refs/heads/other"},
+		},
+		{
+			name:  "invalid command",
+			lines: []string{oldID + " " + newID + " refs/heads/main\x00report-status", "invalid refs/heads/other"},
+		},
+		{
+			name:  "truncated object id",
+			lines: []string{oldID[:39] + " " + newID + " refs/heads/main\x00report-status"},
+		},
+		{
+			name:  "invalid command in push certificate",
+			lines: []string{"push-cert\x00report-status", "certificate version 0.1", "", "invalid refs/heads/main", "push-cert-end"},
+		},
+		{
+			name:  "no commands",
+			lines: []string{"shallow " + oldID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &strings.Builder{}
+			for _, line := range tt.lines {
+				body.WriteString(pktLine(line + "\n"))
+			}
+			body.WriteString("0000")
+			req := httptest.NewRequest(http.MethodPost, "/org/proj/_git/repo/git-receive-pack", strings.NewReader(body.String()))
+			commands, err := readReceivePackCommands(req)
+			if tt.refs == nil {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.refs, commands.refs)
+		})
+	}
+}
+
+func TestIsReceivePackRequest(t *testing.T) {
+	require.True(t, isReceivePackRequest(httptest.NewRequest(http.MethodPost, "/org/proj/_git/repo/git-receive-pack", nil)))
+	require.True(t, isReceivePackRequest(httptest.NewRequest(http.MethodPost, "/org/proj/_git/repo/Git-Receive-Pack", nil)))
+	require.False(t, isReceivePackRequest(httptest.NewRequest(http.MethodPost, "/org/proj/_git/repo/git-upload-pack", nil)))
+}
+
+func TestCheckReceivePack(t *testing.T) {
+	grant := getReceivePackGrant(t)
+	tests := []struct {
+		name   string
+		refs   []string
+		denied []string
+	}{
+		{
+			name:   "allowed ref",
+			refs:   []string{"refs/heads/flux-image-updates/app"},
+			denied: []string{},
+		},
+		{
+			name:   "denied ref",
+			refs:   []string{"refs/heads/main"},
+			denied: []string{"refs/heads/main"},
+		},
+		{
+			name:   "mixed refs",
+			refs:   []string{"refs/heads/flux-image-updates/app", "refs/tags/v1.0.0"},
+			denied: []string{"refs/tags/v1.0.0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			denied := checkReceivePack(grant, &receivePackCommands{refs: tt.refs})
+			refs := []string{}
+			for ref := range denied {
+				refs = append(refs, ref)
+			}
+			require.ElementsMatch(t, tt.denied, refs)
+		})
+	}
+}
+
+func TestWriteReceivePackReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	commands := &receivePackCommands{
+		refs:         []string{"refs/heads/main", "refs/heads/flux-image-updates/app"},
+		capabilities: []string{reportStatusCapability},
+	}
+	denied := map[string]string{"refs/heads/main": "not allowed"}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeReceivePackReport(c, commands, denied)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, receivePackResultType, w.Header().Get("Content-Type"))
+	expected := "000eunpack ok\n" + "0023ng refs/heads/main not allowed\n" + "0043ng refs/heads/flux-image-updates/app push contains denied refs\n" + "0000"
+	require.Equal(t, expected, w.Body.String())
+
+	commands.capabilities = append(commands.capabilities, sideBand64kCapability)
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	writeReceivePackReport(c, commands, denied)
+	require.Equal(t, pktLine("\x01"+expected)+"0000", w.Body.String())
+
+	commands.capabilities = []string{}
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	writeReceivePackReport(c, commands, denied)
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
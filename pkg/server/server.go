@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"time"
@@ -16,11 +18,14 @@ import (
 
 type GitProxy struct {
 	authz *auth.Authorizer
+	authn *auth.ServiceAccountAuthenticator
 }
 
-func NewGitProxy(authz *auth.Authorizer) *GitProxy {
+// NewGitProxy returns a new proxy, service account tokens are only accepted when an authenticator is given.
+func NewGitProxy(authz *auth.Authorizer, authn *auth.ServiceAccountAuthenticator) *GitProxy {
 	return &GitProxy{
 		authz: authz,
+		authn: authn,
 	}
 }
 
@@ -46,14 +51,61 @@ func (g *GitProxy) proxyHandler(c *gin.Context) {
 		c.String(http.StatusUnauthorized, "Missing basic authentication")
 		return
 	}
+	// Service account tokens are exchanged for the token of the grant given to the service account
+	if g.authn != nil && auth.IsServiceAccountToken(token) && g.authz.UsesServiceAccounts() {
+		token, err = g.getServiceAccountGrantToken(c.Request, token)
+		switch {
+		case errors.Is(err, auth.ErrTooManyTokenReviews):
+			//nolint: errcheck //ignore
+			c.Error(fmt.Errorf("received too many service account tokens: %w", err))
+			c.String(http.StatusTooManyRequests, "too many requests")
+			return
+		case errors.Is(err, auth.ErrTokenReviewFailed):
+			//nolint: errcheck //ignore
+			c.Error(fmt.Errorf("could not authenticate service account: %w", err))
+			c.String(http.StatusServiceUnavailable, "service unavailable")
+			return
+		case err != nil:
+			//nolint: errcheck //ignore
+			c.Error(fmt.Errorf("received unauthorized request: %w", err))
+			c.String(http.StatusForbidden, "user not permitted")
+			return
+		}
+	}
 	// Check basic auth with local auth configuration
-	err = g.authz.IsPermitted(c.Request.URL.EscapedPath(), token)
+	err = g.authz.IsRequestPermitted(c.Request, token)
 	if err != nil {
 		//nolint: errcheck //ignore
 		c.Error(fmt.Errorf("received unauthorized request: %w", err))
 		c.String(http.StatusForbidden, "user not permitted")
 		return
 	}
+	// Check the ref updates of pushes before they are forwarded
+	if isReceivePackRequest(c.Request) {
+		grant, err := g.authz.GetGrantByToken(token)
+		if err != nil {
+			//nolint: errcheck //ignore
+			c.Error(fmt.Errorf("received unauthorized request: %w", err))
+			c.String(http.StatusForbidden, "user not permitted")
+			return
+		}
+		if grant.RestrictsRefs() {
+			commands, err := readReceivePackCommands(c.Request)
+			if err != nil {
+				//nolint: errcheck //ignore
+				c.Error(fmt.Errorf("could not read receive pack commands: %w", err))
+				c.String(http.StatusBadRequest, "invalid receive pack request")
+				return
+			}
+			denied := checkReceivePack(grant, commands)
+			if len(denied) > 0 {
+				//nolint: errcheck //ignore
+				c.Error(fmt.Errorf("received push with denied refs: %v", denied))
+				writeReceivePackReport(c, commands, denied)
+				return
+			}
+		}
+	}
 	// Authenticate the request with the proper token
 	req, url, err := g.authz.UpdateRequest(c.Request.Context(), c.Request, token)
 	if err != nil {
@@ -69,6 +121,23 @@ func (g *GitProxy) proxyHandler(c *gin.Context) {
 	proxy.ServeHTTP(c.Writer, req)
 }
 
+func (g *GitProxy) getServiceAccountGrantToken(req *http.Request, token string) (string, error) {
+	// The remote address is used as the source instead of forwarded headers, which can be set by the client
+	source, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		source = req.RemoteAddr
+	}
+	namespace, name, err := g.authn.Authenticate(req.Context(), token, source)
+	if err != nil {
+		return "", err
+	}
+	grant, err := g.authz.GetGrantByServiceAccount(namespace, name, req.URL.EscapedPath())
+	if err != nil {
+		return "", err
+	}
+	return grant.Token, nil
+}
+
 func readinessHandler(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
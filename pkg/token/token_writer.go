@@ -4,12 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/go-logr/logr"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -21,21 +23,26 @@ const (
 	managedByLabelKey   = "app.kubernetes.io/managed-by"
 	managedByLabelValue = "git-auth-proxy"
 	idLabelKey          = "git-auth-proxy.xenit.io/id"
+	revokeAnnotationKey = "git-auth-proxy.xenit.io/revoke"
 	usernameValue       = "git"
 	usernameKey         = "username"
 	passwordKey         = "password"
 	tokenKey            = "token"
+	// syncRetryInterval is how long to wait before syncing the secrets again after a secret could not be written.
+	syncRetryInterval = 30 * time.Second
 )
 
 type TokenWriter struct {
-	client kubernetes.Interface
-	authz  *auth.Authorizer
+	client        kubernetes.Interface
+	authz         *auth.Authorizer
+	retryInterval time.Duration
 }
 
 func NewTokenWriter(client kubernetes.Interface, authz *auth.Authorizer) *TokenWriter {
 	return &TokenWriter{
-		client: client,
-		authz:  authz,
+		client:        client,
+		authz:         authz,
+		retryInterval: syncRetryInterval,
 	}
 }
 
@@ -43,31 +50,51 @@ func (t *TokenWriter) Start(ctx context.Context) error {
 	log := logr.FromContextOrDiscard(ctx).WithName("token")
 	log.Info("Starting token writer")
 
-	// clean up all secrets managed by git-auth-proxy
-	labelSelector := metav1.LabelSelector{MatchLabels: map[string]string{managedByLabelKey: managedByLabelValue}}
-	labelMap, err := metav1.LabelSelectorAsMap(&labelSelector)
-	if err != nil {
-		return err
+	nsWatched := false
+	if t.authz.HasNamespaceSelectors() {
+		if err := t.watchNamespaces(ctx); err != nil {
+			return err
+		}
+		nsWatched = true
 	}
-	selectorString := labels.SelectorFromSet(labelMap).String()
-	oldSecrets, err := t.client.CoreV1().Secrets("").List(ctx, metav1.ListOptions{LabelSelector: selectorString})
+
+	// write the secrets of all endpoints and clean up secrets which do not have the current token
+	selectorString, err := managedSelector()
 	if err != nil {
-		return fmt.Errorf("could not list secrets: %w", err)
+		return err
 	}
-	for i := range oldSecrets.Items {
-		if err := t.deleteSecret(ctx, oldSecrets.Items[i].Name, oldSecrets.Items[i].Namespace); err != nil {
-			return err
-		}
+	// Secrets which cannot be written are retried instead of stopping the proxy, so that previous tokens which are kept
+	// until the rotated tokens are written can expire
+	var retry <-chan time.Time
+	if err := t.syncSecrets(ctx, selectorString); err != nil {
+		log.Error(err, "could not create initial secrets")
+		retry = time.After(t.retryInterval)
 	}
 
-	// initial write of the new secrets
-	for _, e := range t.authz.GetEndpoints() {
-		for _, ns := range e.Namespaces {
-			if err := t.createSecret(ctx, e.SecretName, ns, e.Token, e.ID()); err != nil {
-				return fmt.Errorf("could not create initial secrets: %w", err)
+	// write secrets for repositories which are added or removed after start
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-retry:
+			case <-t.authz.Updated():
+				// Namespace selectors may be added when the configuration is reloaded
+				if !nsWatched && t.authz.HasNamespaceSelectors() {
+					if err := t.watchNamespaces(ctx); err != nil {
+						log.Error(err, "could not watch namespaces")
+					} else {
+						nsWatched = true
+					}
+				}
+			}
+			retry = nil
+			if err := t.syncSecrets(ctx, selectorString); err != nil {
+				log.Error(err, "could not sync secrets")
+				retry = time.After(t.retryInterval)
 			}
 		}
-	}
+	}()
 
 	// listen for secrets changes
 	informer := cache.NewSharedIndexInformer(
@@ -85,6 +112,7 @@ func (t *TokenWriter) Start(ctx context.Context) error {
 	)
 	_, err = informer.AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
+			AddFunc:    t.secretAdded(ctx),
 			UpdateFunc: t.secretUpdated(ctx),
 			DeleteFunc: t.secretDeleted(ctx),
 		},
@@ -98,6 +126,226 @@ func (t *TokenWriter) Start(ctx context.Context) error {
 	return nil
 }
 
+// watchNamespaces watches namespaces so that the namespace selectors are applied before the secrets are written. It is
+// only called once an endpoint has a namespace selector, so that namespaces are not watched when they are not used.
+func (t *TokenWriter) watchNamespaces(ctx context.Context) error {
+	nsInformer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return t.client.CoreV1().Namespaces().List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return t.client.CoreV1().Namespaces().Watch(ctx, options)
+			},
+		},
+		&v1.Namespace{}, 0, cache.Indexers{},
+	)
+	_, err := nsInformer.AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { t.namespacesUpdated(ctx, nsInformer.GetStore()) },
+			UpdateFunc: func(interface{}, interface{}) { t.namespacesUpdated(ctx, nsInformer.GetStore()) },
+			DeleteFunc: func(interface{}) { t.namespacesUpdated(ctx, nsInformer.GetStore()) },
+		},
+	)
+	if err != nil {
+		return err
+	}
+	go nsInformer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), nsInformer.HasSynced) {
+		return ctx.Err()
+	}
+	t.namespacesUpdated(ctx, nsInformer.GetStore())
+	return nil
+}
+
+// LoadTokens restores the tokens stored in the managed secrets so that tokens are kept when the proxy is restarted.
+// It has to be called before the token writer is started.
+func (t *TokenWriter) LoadTokens(ctx context.Context) error {
+	selectorString, err := managedSelector()
+	if err != nil {
+		return err
+	}
+	secrets, err := t.client.CoreV1().Secrets("").List(ctx, metav1.ListOptions{LabelSelector: selectorString})
+	if err != nil {
+		return fmt.Errorf("could not list secrets: %w", err)
+	}
+	// Secrets with the name of their endpoint are restored first, so that copies of them cannot replace their tokens
+	tokens := []auth.PersistedToken{}
+	copies := []auth.PersistedToken{}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		id, ok := secret.Annotations[idLabelKey]
+		if !ok {
+			continue
+		}
+		// Tokens which have been requested to be revoked are replaced by the new tokens issued at start
+		if _, revoke := secret.Annotations[revokeAnnotationKey]; revoke {
+			continue
+		}
+		token := getSecretToken(secret)
+		if token == "" {
+			continue
+		}
+		persisted := auth.PersistedToken{ID: id, Namespace: secret.Namespace, Token: token}
+		if e, err := t.authz.GetEndpointById(id); err == nil && e.SecretName != secret.Name {
+			copies = append(copies, persisted)
+			continue
+		}
+		tokens = append(tokens, persisted)
+	}
+	tokens = append(tokens, copies...)
+	// Duplicated tokens, for example in copies of managed secrets, must not prevent the proxy from starting
+	if err := t.authz.RestoreTokens(tokens); err != nil {
+		logr.FromContextOrDiscard(ctx).WithName("token").Error(err, "skipped persisted tokens")
+	}
+	return nil
+}
+
+// namespacesUpdated passes the labels of all namespaces to the authorizer, which updates the grants of the namespace selectors.
+func (t *TokenWriter) namespacesUpdated(ctx context.Context, store cache.Store) {
+	log := logr.FromContextOrDiscard(ctx).WithName("token")
+	namespaces := map[string]map[string]string{}
+	for _, obj := range store.List() {
+		ns, ok := obj.(*v1.Namespace)
+		if !ok {
+			log.Error(errors.New("could not convert to namespace"), "could not get namespace")
+			continue
+		}
+		namespaces[ns.Name] = ns.Labels
+	}
+	if err := t.authz.UpdateNamespaces(namespaces); err != nil {
+		log.Error(err, "could not update namespaces")
+	}
+}
+
+// syncSecrets creates the secrets of new endpoints, replaces secrets which do not contain the current token and deletes
+// the secrets of endpoints which have been removed.
+func (t *TokenWriter) syncSecrets(ctx context.Context, selectorString string) error {
+	secrets, err := t.client.CoreV1().Secrets("").List(ctx, metav1.ListOptions{LabelSelector: selectorString})
+	if err != nil {
+		return fmt.Errorf("could not list secrets: %w", err)
+	}
+	existing := map[types.NamespacedName]*v1.Secret{}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		existing[types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}] = secret
+		// Secrets which were annotated before they were watched are revoked before the endpoints are read, so that they
+		// are written with the new token instead of the revoked token
+		t.revokeRequested(ctx, secret, secret.Annotations[idLabelKey])
+	}
+
+	// Errors are collected so that a secret which cannot be written does not prevent the other secrets from being written
+	errs := []error{}
+	desired := map[types.NamespacedName]bool{}
+	for _, e := range t.authz.GetEndpoints() {
+		for _, g := range e.Grants {
+			// Service accounts authenticate with their own tokens so no secret is required
+			if g.UsesServiceAccounts() {
+				continue
+			}
+			key := types.NamespacedName{Namespace: g.Namespace, Name: e.SecretName}
+			desired[key] = true
+			secret, ok := existing[key]
+			if !ok {
+				if err := t.createSecret(ctx, e.SecretName, g.Namespace, g.Token, e.ID()); err != nil {
+					errs = append(errs, fmt.Errorf("could not create secret %s: %w", key, err))
+				}
+				continue
+			}
+			// Secrets are updated in place so that the secret is never missing when a token is rotated
+			if isSecretCurrent(secret, g.Token, e.ID()) {
+				t.authz.TokenWritten(g.Token)
+				continue
+			}
+			if err := t.updateSecret(ctx, withToken(secret, g.Token, e.ID()), g.Namespace); err != nil {
+				errs = append(errs, fmt.Errorf("could not update secret %s: %w", key, err))
+			}
+		}
+	}
+	for key := range existing {
+		if desired[key] {
+			continue
+		}
+		if err := t.deleteSecret(ctx, key.Name, key.Namespace); err != nil {
+			errs = append(errs, fmt.Errorf("could not delete secret %s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isSecretCurrent returns true if the secret contains the token for the endpoint and no revocation is requested.
+func isSecretCurrent(secret *v1.Secret, token string, id string) bool {
+	_, revoke := secret.Annotations[revokeAnnotationKey]
+	return !revoke && secret.Annotations[idLabelKey] == id && getSecretToken(secret) == token
+}
+
+// withToken returns a copy of the secret which contains the token for the endpoint.
+func withToken(secret *v1.Secret, token string, id string) *v1.Secret {
+	secret = secret.DeepCopy()
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[idLabelKey] = id
+	delete(secret.Annotations, revokeAnnotationKey)
+	// String data replaces data when written, the keys are removed from data as clients may not merge them
+	for _, key := range []string{usernameKey, passwordKey, tokenKey} {
+		delete(secret.Data, key)
+	}
+	secret.StringData = map[string]string{
+		usernameKey: usernameValue,
+		passwordKey: token,
+		tokenKey:    token,
+	}
+	return secret
+}
+
+// managedSelector returns the label selector of the secrets managed by git-auth-proxy.
+func managedSelector() (string, error) {
+	labelSelector := metav1.LabelSelector{MatchLabels: map[string]string{managedByLabelKey: managedByLabelValue}}
+	labelMap, err := metav1.LabelSelectorAsMap(&labelSelector)
+	if err != nil {
+		return "", err
+	}
+	return labels.SelectorFromSet(labelMap).String(), nil
+}
+
+// getSecretToken returns the token of the secret. The API server only returns data, while string data is kept by
+// clients which have not read the secret back.
+func getSecretToken(secret *v1.Secret) string {
+	if token, ok := secret.Data[tokenKey]; ok {
+		return string(token)
+	}
+	return secret.StringData[tokenKey]
+}
+
+// secretAdded revokes the tokens of secrets which have been annotated before the informer listed them.
+func (t *TokenWriter) secretAdded(ctx context.Context) func(obj interface{}) {
+	log := logr.FromContextOrDiscard(ctx)
+	return func(obj interface{}) {
+		secret, ok := obj.(*v1.Secret)
+		if !ok {
+			log.Error(errors.New("could not convert to secret"), "could not get added secret")
+			return
+		}
+		t.revokeRequested(ctx, secret, secret.Annotations[idLabelKey])
+	}
+}
+
+// revokeRequested revokes the token of the secret if the secret has the revoke annotation and returns true if it has.
+// The secret is written with the new token when the secrets are synced after the revocation.
+func (t *TokenWriter) revokeRequested(ctx context.Context, secret *v1.Secret, id string) bool {
+	log := logr.FromContextOrDiscard(ctx)
+	if _, ok := secret.Annotations[revokeAnnotationKey]; !ok {
+		return false
+	}
+	if err := t.authz.RevokeToken(id, secret.Namespace); err != nil {
+		log.Error(err, "could not revoke token", "name", secret.Name, "namespace", secret.Namespace)
+		return true
+	}
+	log.Info("revoked token", "name", secret.Name, "namespace", secret.Namespace)
+	return true
+}
+
 func (t *TokenWriter) secretUpdated(ctx context.Context) func(oldObj, newObj interface{}) {
 	log := logr.FromContextOrDiscard(ctx)
 	return func(oldObj, newObj interface{}) {
@@ -106,7 +354,30 @@ func (t *TokenWriter) secretUpdated(ctx context.Context) func(oldObj, newObj int
 			log.Error(errors.New("could not convert to secret"), "could not get old secret")
 			return
 		}
-		err := t.updateSecret(context.Background(), oldSecret, oldSecret.Namespace)
+		newSecret, ok := newObj.(*v1.Secret)
+		if !ok {
+			log.Error(errors.New("could not convert to secret"), "could not get new secret")
+			return
+		}
+		e, err := t.authz.GetEndpointById(oldSecret.Annotations[idLabelKey])
+		if err != nil {
+			log.Error(err, "updated secret does not match an endpoint", "name", newSecret.Name, "namespace", newSecret.Namespace)
+			return
+		}
+		g, err := e.GetGrant(newSecret.Namespace)
+		if err != nil {
+			log.Error(err, "updated secret does not match a namespace", "name", newSecret.Name, "namespace", newSecret.Namespace)
+			return
+		}
+		if t.revokeRequested(ctx, newSecret, e.ID()) {
+			return
+		}
+		// Updates which write the current token, such as after a rotation, are kept
+		if isSecretCurrent(newSecret, g.Token, e.ID()) {
+			t.authz.TokenWritten(g.Token)
+			return
+		}
+		err = t.updateSecret(context.Background(), withToken(newSecret, g.Token, e.ID()), newSecret.Namespace)
 		if err != nil {
 			log.Error(err, "secret update error")
 			return
@@ -133,7 +404,15 @@ func (t *TokenWriter) secretDeleted(ctx context.Context) func(obj interface{}) {
 			log.Error(err, "deleted secret does not match an endpoint", "name", secret.Name, "namespace", secret.Namespace)
 			return
 		}
-		err = t.createSecret(context.Background(), e.SecretName, secret.Namespace, e.Token, e.ID())
+		g, err := e.GetGrant(secret.Namespace)
+		if err != nil {
+			log.Error(err, "deleted secret does not match a namespace", "name", secret.Name, "namespace", secret.Namespace)
+			return
+		}
+		if g.UsesServiceAccounts() {
+			return
+		}
+		err = t.createSecret(context.Background(), e.SecretName, secret.Namespace, g.Token, e.ID())
 		if err != nil {
 			log.Error(err, "Unable to created secret after deletion")
 			return
@@ -165,6 +444,7 @@ func (t *TokenWriter) createSecret(ctx context.Context, name string, namespace s
 		log.Error(err, "could not create secret", "name", name, "namespace", namespace)
 		return err
 	}
+	t.authz.TokenWritten(token)
 	log.Info("created secret", "name", name, "namespace", namespace)
 	return nil
 }
@@ -176,6 +456,7 @@ func (t *TokenWriter) updateSecret(ctx context.Context, secret *v1.Secret, names
 		log.Error(err, "could not update secret", "name", secret.Name, "namespace", namespace)
 		return err
 	}
+	t.authz.TokenWritten(getSecretToken(secret))
 	log.Info("updated secret", "name", secret.Name, "namespace", namespace)
 	return nil
 }
@@ -2,12 +2,22 @@ package token
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 
 	"github.com/xenitab/git-auth-proxy/pkg/auth"
 	"github.com/xenitab/git-auth-proxy/pkg/config"
@@ -27,7 +37,7 @@ func TestBasic(t *testing.T) {
 					{
 						Project:            "proj",
 						Name:               "repo",
-						Namespaces:         []string{"foo", "bar"},
+						Namespaces:         []*config.Namespace{{Name: "foo"}, {Name: "bar"}, {Name: "baz", ServiceAccounts: []string{"default"}}},
 						SecretNameOverride: "git-auth",
 					},
 				},
@@ -49,6 +59,11 @@ func TestBasic(t *testing.T) {
 
 	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
 	require.NoError(t, err)
+	fooGrant, err := endpoint.GetGrant("foo")
+	require.NoError(t, err)
+	barGrant, err := endpoint.GetGrant("bar")
+	require.NoError(t, err)
+	require.NotEqual(t, fooGrant.Token, barGrant.Token)
 	require.Eventuallyf(t, func() bool {
 		secret, err := client.CoreV1().Secrets("foo").Get(ctx, "git-auth", v1.GetOptions{})
 		if err != nil {
@@ -58,7 +73,7 @@ func TestBasic(t *testing.T) {
 		if !ok {
 			return false
 		}
-		if val != endpoint.Token {
+		if val != fooGrant.Token {
 			return false
 		}
 		return true
@@ -66,6 +81,9 @@ func TestBasic(t *testing.T) {
 
 	secret, err := client.CoreV1().Secrets("bar").Get(ctx, "git-auth", v1.GetOptions{})
 	require.NoError(t, err)
+	// No secret is written for namespaces which authenticate with service accounts
+	_, err = client.CoreV1().Secrets("baz").Get(ctx, "git-auth", v1.GetOptions{})
+	require.Error(t, err)
 	secret.StringData["token"] = "stuff"
 	_, err = client.CoreV1().Secrets("bar").Update(ctx, secret, v1.UpdateOptions{})
 	require.NoError(t, err)
@@ -78,7 +96,7 @@ func TestBasic(t *testing.T) {
 		if !ok {
 			return false
 		}
-		if val != endpoint.Token {
+		if val != barGrant.Token {
 			return false
 		}
 		return true
@@ -95,9 +113,626 @@ func TestBasic(t *testing.T) {
 		if !ok {
 			return false
 		}
-		if val != endpoint.Token {
+		if val != barGrant.Token {
 			return false
 		}
 		return true
 	}, 5*time.Second, 1*time.Second, "secret git-auth not found in namespace bar")
 }
+
+func TestSecretErrors(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}, {Name: "bar"}, {Name: "baz"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != "bar" {
+			return false, nil, nil
+		}
+		return true, nil, errors.New("namespace is terminating")
+	})
+	tokenWriter := NewTokenWriter(client, authz)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tokenWriter.Start(ctx)
+	}()
+
+	// A secret which cannot be written should not stop the other secrets from being written
+	for _, namespace := range []string{"foo", "baz"} {
+		require.Eventuallyf(t, func() bool {
+			_, err := client.CoreV1().Secrets(namespace).Get(ctx, "org-proj-repo", v1.GetOptions{})
+			return err == nil
+		}, 5*time.Second, 100*time.Millisecond, "secret not created in namespace %s", namespace)
+	}
+	select {
+	case err := <-errCh:
+		require.Fail(t, "token writer stopped", err)
+	default:
+	}
+}
+
+func TestRepositoryPatterns(t *testing.T) {
+	names := []string{"team-a-config"}
+	mu := sync.Mutex{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		values := []map[string]string{}
+		for _, name := range names {
+			values = append(values, map[string]string{"name": name})
+		}
+		//nolint:errcheck // ignore
+		json.NewEncoder(w).Encode(map[string]any{"value": values})
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     u.Host,
+				Scheme:   u.Scheme,
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "team-*-config",
+						Namespaces: []*config.Namespace{{Name: "foo"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset()
+	tokenWriter := NewTokenWriter(client, authz)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		err := tokenWriter.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	require.NoError(t, authz.RefreshRepositories(ctx))
+	require.Eventuallyf(t, func() bool {
+		_, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-team-a-config", v1.GetOptions{})
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond, "secret for team-a-config not created")
+
+	mu.Lock()
+	names = []string{"team-b-config"}
+	mu.Unlock()
+	require.NoError(t, authz.RefreshRepositories(ctx))
+	require.Eventuallyf(t, func() bool {
+		_, errA := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-team-a-config", v1.GetOptions{})
+		_, errB := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-team-b-config", v1.GetOptions{})
+		return errA != nil && errB == nil
+	}, 5*time.Second, 100*time.Millisecond, "secrets not updated after repositories changed")
+}
+
+func TestPersistTokens(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}, {Name: "bar"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	for _, secret := range []*corev1.Secret{
+		{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "org-proj-repo",
+				Namespace:   "foo",
+				Labels:      map[string]string{managedByLabelKey: managedByLabelValue},
+				Annotations: map[string]string{idLabelKey: "foo-org-proj-repo"},
+			},
+			Data: map[string][]byte{tokenKey: []byte("persisted")},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "org-proj-removed",
+				Namespace:   "foo",
+				Labels:      map[string]string{managedByLabelKey: managedByLabelValue},
+				Annotations: map[string]string{idLabelKey: "foo-org-proj-removed"},
+			},
+			Data: map[string][]byte{tokenKey: []byte("removed")},
+		},
+		// Copies of managed secrets do not prevent the tokens from being loaded
+		{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "copy",
+				Namespace:   "foo",
+				Labels:      map[string]string{managedByLabelKey: managedByLabelValue},
+				Annotations: map[string]string{idLabelKey: "foo-org-proj-repo"},
+			},
+			Data: map[string][]byte{tokenKey: []byte("copied")},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "duplicate",
+				Namespace:   "foo",
+				Labels:      map[string]string{managedByLabelKey: managedByLabelValue},
+				Annotations: map[string]string{idLabelKey: "foo-org-proj-repo"},
+			},
+			Data: map[string][]byte{tokenKey: []byte("persisted")},
+		},
+	} {
+		_, err := client.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, v1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	tokenWriter := NewTokenWriter(client, authz)
+	require.NoError(t, tokenWriter.LoadTokens(ctx))
+	go func() {
+		err := tokenWriter.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	fooGrant, err := endpoint.GetGrant("foo")
+	require.NoError(t, err)
+	require.Equal(t, "persisted", fooGrant.Token)
+	barGrant, err := endpoint.GetGrant("bar")
+	require.NoError(t, err)
+	require.Eventuallyf(t, func() bool {
+		secret, err := client.CoreV1().Secrets("bar").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err == nil && getSecretToken(secret) == barGrant.Token
+	}, 5*time.Second, 100*time.Millisecond, "secret for new namespace not created")
+	_, err = client.CoreV1().Secrets("foo").Get(ctx, "org-proj-removed", v1.GetOptions{})
+	require.Error(t, err)
+	secret, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "persisted", getSecretToken(secret))
+}
+
+func TestRotateTokens(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset()
+	tokenWriter := NewTokenWriter(client, authz)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		err := tokenWriter.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	require.Eventuallyf(t, func() bool {
+		_, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond, "secret not created")
+	require.NoError(t, authz.RotateTokens(time.Minute))
+	endpoint, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.Eventuallyf(t, func() bool {
+		secret, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err == nil && getSecretToken(secret) == endpoint.Grants[0].Token
+	}, 5*time.Second, 100*time.Millisecond, "secret not updated after rotation")
+	// The secret is updated in place instead of being recreated
+	for _, action := range client.Actions() {
+		require.NotEqual(t, "delete", action.GetVerb())
+	}
+}
+
+func TestRotateTokensSecretErrors(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}, {Name: "bar"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset()
+	failing := atomic.Bool{}
+	client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != "foo" || !failing.Load() {
+			return false, nil, nil
+		}
+		return true, nil, errors.New("namespace is terminating")
+	})
+	tokenWriter := NewTokenWriter(client, authz)
+	tokenWriter.retryInterval = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		err := tokenWriter.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	for _, namespace := range []string{"foo", "bar"} {
+		require.Eventuallyf(t, func() bool {
+			_, err := client.CoreV1().Secrets(namespace).Get(ctx, "org-proj-repo", v1.GetOptions{})
+			return err == nil
+		}, 5*time.Second, 100*time.Millisecond, "secret not created in namespace %s", namespace)
+	}
+	before, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	failing.Store(true)
+	require.NoError(t, authz.RotateTokens(time.Nanosecond))
+	after, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+
+	// The previous token is kept after the grace period until the new token has been written to the secret
+	path := "/org/proj/_git/repo"
+	require.Eventuallyf(t, func() bool {
+		return authz.IsPermitted(path, before.Grants[1].Token) != nil
+	}, 5*time.Second, 100*time.Millisecond, "previous token of written secret not expired")
+	require.NoError(t, authz.IsPermitted(path, before.Grants[0].Token))
+
+	// Secrets which could not be written are retried
+	failing.Store(false)
+	require.Eventuallyf(t, func() bool {
+		secret, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err == nil && getSecretToken(secret) == after.Grants[0].Token
+	}, 5*time.Second, 100*time.Millisecond, "secret not updated after retry")
+	require.Error(t, authz.IsPermitted(path, before.Grants[0].Token))
+}
+
+func TestRevokeToken(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}, {Name: "bar"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset()
+	tokenWriter := NewTokenWriter(client, authz)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		err := tokenWriter.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	before, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.Eventuallyf(t, func() bool {
+		_, errFoo := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		_, errBar := client.CoreV1().Secrets("bar").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return errFoo == nil && errBar == nil
+	}, 5*time.Second, 100*time.Millisecond, "secrets not created")
+	// The revocation is handled both when the informer lists the annotated secret and when it watches the update
+
+	secret, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+	require.NoError(t, err)
+	secret.Annotations[revokeAnnotationKey] = "true"
+	_, err = client.CoreV1().Secrets("foo").Update(ctx, secret, v1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventuallyf(t, func() bool {
+		secret, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		_, revoke := secret.Annotations[revokeAnnotationKey]
+		return !revoke && getSecretToken(secret) != before.Grants[0].Token
+	}, 5*time.Second, 100*time.Millisecond, "secret not updated after revocation")
+
+	after, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	secret, err = client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, after.Grants[0].Token, getSecretToken(secret))
+	require.Error(t, authz.IsPermitted("/org/proj/_git/repo", before.Grants[0].Token))
+	secret, err = client.CoreV1().Secrets("bar").Get(ctx, "org-proj-repo", v1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, before.Grants[1].Token, getSecretToken(secret))
+}
+
+func TestRevokeTokenAtStart(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	before, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	// The secret was annotated while the proxy was not running, and contains the token which is persisted or issued at start
+	secret := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "org-proj-repo",
+			Namespace:   "foo",
+			Labels:      map[string]string{managedByLabelKey: managedByLabelValue},
+			Annotations: map[string]string{idLabelKey: before.ID(), revokeAnnotationKey: "true"},
+		},
+		Data: map[string][]byte{tokenKey: []byte(before.Grants[0].Token)},
+	}
+	client := fake.NewSimpleClientset(secret)
+	tokenWriter := NewTokenWriter(client, authz)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	require.NoError(t, tokenWriter.LoadTokens(ctx))
+	go func() {
+		err := tokenWriter.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	require.Eventuallyf(t, func() bool {
+		secret, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		_, revoke := secret.Annotations[revokeAnnotationKey]
+		after, err := authz.GetEndpointById("foo-org-proj-repo")
+		return err == nil && !revoke && getSecretToken(secret) == after.Grants[0].Token
+	}, 5*time.Second, 100*time.Millisecond, "secret not updated after revocation")
+	secret, err = client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+	require.NoError(t, err)
+	require.NotEqual(t, before.Grants[0].Token, getSecretToken(secret))
+	require.Error(t, authz.IsPermitted("/org/proj/_git/repo", before.Grants[0].Token))
+}
+
+func TestLoadTokensSkipsRevoked(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	secret := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "org-proj-repo",
+			Namespace:   "foo",
+			Labels:      map[string]string{managedByLabelKey: managedByLabelValue},
+			Annotations: map[string]string{idLabelKey: "foo-org-proj-repo", revokeAnnotationKey: "true"},
+		},
+		Data: map[string][]byte{tokenKey: []byte("leaked")},
+	}
+	tokenWriter := NewTokenWriter(fake.NewSimpleClientset(secret), authz)
+	require.NoError(t, tokenWriter.LoadTokens(context.TODO()))
+	e, err := authz.GetEndpointById("foo-org-proj-repo")
+	require.NoError(t, err)
+	require.NotEqual(t, "leaked", e.Grants[0].Token)
+	require.Error(t, authz.IsPermitted("/org/proj/_git/repo", "leaked"))
+}
+
+func TestNamespaceSelector(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:           "proj",
+						Name:              "repo",
+						NamespaceSelector: &v1.LabelSelector{MatchLabels: map[string]string{"tenant": "true"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "foo", Labels: map[string]string{"tenant": "true"}}},
+		&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "bar"}},
+	)
+	tokenWriter := NewTokenWriter(client, authz)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		err := tokenWriter.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	require.Eventuallyf(t, func() bool {
+		_, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond, "secret not created in selected namespace")
+	_, err = client.CoreV1().Secrets("bar").Get(ctx, "org-proj-repo", v1.GetOptions{})
+	require.Error(t, err)
+
+	ns, err := client.CoreV1().Namespaces().Get(ctx, "bar", v1.GetOptions{})
+	require.NoError(t, err)
+	ns.Labels = map[string]string{"tenant": "true"}
+	_, err = client.CoreV1().Namespaces().Update(ctx, ns, v1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventuallyf(t, func() bool {
+		_, err := client.CoreV1().Secrets("bar").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond, "secret not created when namespace label is added")
+
+	ns, err = client.CoreV1().Namespaces().Get(ctx, "foo", v1.GetOptions{})
+	require.NoError(t, err)
+	ns.Labels = map[string]string{}
+	_, err = client.CoreV1().Namespaces().Update(ctx, ns, v1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventuallyf(t, func() bool {
+		_, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err != nil
+	}, 5*time.Second, 100*time.Millisecond, "secret not deleted when namespace label is removed")
+}
+
+func TestNamespacesWatchedWithSelector(t *testing.T) {
+	cfg := &config.Configuration{
+		Organizations: []*config.Organization{
+			{
+				Provider: "azuredevops",
+				Name:     "org",
+				Host:     "foo",
+				Scheme:   "https",
+				AzureDevOps: config.AzureDevOps{
+					Pat: "foo",
+				},
+				Repositories: []*config.Repository{
+					{
+						Project:    "proj",
+						Name:       "repo",
+						Namespaces: []*config.Namespace{{Name: "foo"}},
+					},
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "bar", Labels: map[string]string{"tenant": "true"}}},
+	)
+	tokenWriter := NewTokenWriter(client, authz)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		err := tokenWriter.Start(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	require.Eventuallyf(t, func() bool {
+		_, err := client.CoreV1().Secrets("foo").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond, "secret not created")
+	// Namespaces are not watched without namespace selectors
+	for _, action := range client.Actions() {
+		require.NotEqual(t, "namespaces", action.GetResource().Resource)
+	}
+
+	cfg.Organizations[0].Repositories[0].NamespaceSelector = &v1.LabelSelector{MatchLabels: map[string]string{"tenant": "true"}}
+	require.NoError(t, authz.Reload(ctx, cfg))
+	require.Eventuallyf(t, func() bool {
+		_, err := client.CoreV1().Secrets("bar").Get(ctx, "org-proj-repo", v1.GetOptions{})
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond, "secret not created in namespace selected after reload")
+}